@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/validator"
+)
+
+// listUsersHandler lists the user accounts, filtered by email address, activation
+// status and creation time, in pages linked by cursors like listBooksHandler.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email         string
+		Activated     *bool
+		CreatedAfter  *time.Time
+		CreatedBefore *time.Time
+		data.KeysetFilters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Email = app.readString(qs, "email", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+
+	input.KeysetFilters.Cursor = app.readCursor(qs, "cursor", v)
+	input.KeysetFilters.CursorSize = app.readInt(qs, "cursor_size", 20, v)
+
+	input.KeysetFilters.Sort = app.readString(qs, "sort", "id")
+	input.KeysetFilters.SortSafeList = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if total := app.readBool(qs, "total", v); total != nil {
+		input.KeysetFilters.Total = *total
+	}
+
+	if data.ValidateKeysetFilters(v, input.KeysetFilters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Email, input.Activated, input.CreatedAfter, input.CreatedBefore, input.KeysetFilters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			v.AddError("cursor", "is invalid")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUserHandler responds with a user account and its permissions.
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserHandler activates or deactivates a user account and replaces its
+// permissions. Deactivated users are signed out and lose their API keys.
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Activated   *bool    `json:"activated"`
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	v := validator.New()
+
+	v.Check(input.Activated != nil || input.Permissions != nil, "activated", "either activated or permissions must be provided")
+	if input.Activated != nil {
+		v.Check(*input.Activated || user.ID != admin.ID, "activated", "you cannot deactivate your own account")
+	}
+	if input.Permissions != nil {
+		v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+		for _, code := range input.Permissions {
+			v.Check(known.Include(code), "permissions", "must only contain known permissions: "+strings.Join(known, ", "))
+		}
+		v.Check(data.Permissions(input.Permissions).Include("users:admin") || user.ID != admin.ID, "permissions", "you cannot remove users:admin from your own account")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var permissions data.Permissions
+
+	// Apply the changes and record them in the audit trail in one transaction, so
+	// that no change is left unaudited.
+	err = app.models.Transact(func(tx data.Models) error {
+		var err error
+
+		if input.Activated != nil && *input.Activated != user.Activated {
+			user.Activated = *input.Activated
+
+			err = tx.Users.Update(user)
+			if err != nil {
+				return err
+			}
+
+			action := "user.activated"
+			var details interface{}
+			if !user.Activated {
+				action = "user.deactivated"
+
+				details, err = app.revokeUserAccess(tx, user.ID)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = app.recordAudit(tx, r, action, data.AuditTargetUser, user.ID, details)
+			if err != nil {
+				return err
+			}
+		}
+
+		permissions, err = tx.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			return err
+		}
+
+		if input.Permissions != nil {
+			err = tx.Permissions.SetForUser(user.ID, input.Permissions...)
+			if err != nil {
+				return err
+			}
+
+			details := map[string]interface{}{"before": permissions, "after": input.Permissions}
+
+			err = app.recordAudit(tx, r, "user.permissions_updated", data.AuditTargetUser, user.ID, details)
+			if err != nil {
+				return err
+			}
+
+			permissions = input.Permissions
+		}
+		return nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteUserHandler deletes a user account along with its tokens.
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == app.contextGetUser(r).ID {
+		app.badRequestResponse(w, r, errors.New("use DELETE /v1/users/me to delete your own account"))
+		return
+	}
+
+	err := app.models.Transact(func(tx data.Models) error {
+		err := tx.Users.Delete(user.ID)
+		if err != nil {
+			return err
+		}
+
+		details := map[string]interface{}{"email": user.Email}
+
+		return app.recordAudit(tx, r, "user.deleted", data.AuditTargetUser, user.ID, details)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// forcePasswordResetHandler replaces the password of a user with a random one,
+// signs them out, deletes their API keys and emails them a password reset token,
+// for example when the account is suspected to be compromised.
+func (app *application) forcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := user.Password.Scramble()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Transact(func(tx data.Models) error {
+		err := tx.Users.Update(user)
+		if err != nil {
+			return err
+		}
+
+		details, err := app.revokeUserAccess(tx, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return app.recordAudit(tx, r, "user.password_reset_forced", data.AuditTargetUser, user.ID, details)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The token is only sent once the new password has been committed.
+	app.sendPasswordResetToken(user)
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "the user was signed out and will receive an email containing password reset instructions"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeUserSessionsHandler signs a user out of every session and deletes their
+// API keys. Signed access tokens stay valid until they expire, but can no longer
+// be refreshed.
+func (app *application) revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Transact(func(tx data.Models) error {
+		details, err := app.revokeUserAccess(tx, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return app.recordAudit(tx, r, "user.sessions_revoked", data.AuditTargetUser, user.ID, details)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all sessions of the user successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeUserAccess signs a user out of every session and deletes their API keys,
+// which would otherwise keep working. It returns the details of the audit event
+// of the change, with the number of keys deleted.
+func (app *application) revokeUserAccess(tx data.Models, userID int64) (map[string]interface{}, error) {
+	err := app.revokeSessions(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := tx.APIKeys.DeleteAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"api_keys_revoked": keys}, nil
+}
+
+// loadUser reads the user identified by the id parameter of the request.
+func (app *application) loadUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
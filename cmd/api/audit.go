@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/validator"
+)
+
+// newAuditEvent returns an audit event for a change made by the request, with
+// the actor, request ID and client IP address filled in.
+func (app *application) newAuditEvent(r *http.Request, action, targetType string, targetID int64) *data.AuditEvent {
+	event := &data.AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		RequestID:  app.contextGetRequestID(r),
+		IP:         app.clientIP(r),
+	}
+
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		event.ActorID = &user.ID
+	}
+
+	return event
+}
+
+// recordAudit records a change made by the authenticated user in the audit
+// trail, using the models of the transaction in which the change was made. The
+// details are stored as JSON and may be nil.
+func (app *application) recordAudit(tx data.Models, r *http.Request, action, targetType string, targetID int64, details interface{}) error {
+	event := app.newAuditEvent(r, action, targetType, targetID)
+
+	if details != nil {
+		js, err := json.Marshal(details)
+		if err != nil {
+			return err
+		}
+		event.Details = js
+	}
+
+	return tx.Audit.Insert(event)
+}
+
+// listAuditEventsHandler lists the audit trail, newest events first, filtered by
+// actor, action, target, request ID and time.
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AuditFilter
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.ActorID = int64(app.readInt(qs, "actor_id", 0, v))
+	input.Action = app.readString(qs, "action", "")
+	input.TargetType = app.readString(qs, "target_type", "")
+	input.TargetID = int64(app.readInt(qs, "target_id", 0, v))
+	input.RequestID = app.readString(qs, "request_id", "")
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+
+	input.Filters.Cursor = app.readInt(qs, "cursor", 1, v)
+	input.Filters.CursorSize = app.readInt(qs, "cursor_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafeList = []string{"id", "-id"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.Audit.GetAll(input.AuditFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit_events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recordBookChange records a change to a book in the audit trail, using the
+// models of the transaction in which the change was made. before is nil for a
+// created book and after is nil for a deleted one.
+func (app *application) recordBookChange(tx data.Models, r *http.Request, action string, before, after *data.Book) error {
+	// Assign the books to interface values only when they are set, so that nil
+	// pointers are seen as nil by SetChanges().
+	var beforeValue, afterValue interface{}
+	var id int64
+
+	if before != nil {
+		beforeValue = before
+		id = before.ID
+	}
+	if after != nil {
+		afterValue = after
+		id = after.ID
+	}
+
+	event := app.newAuditEvent(r, action, data.AuditTargetBook, id)
+
+	err := event.SetChanges(beforeValue, afterValue)
+	if err != nil {
+		return err
+	}
+
+	return tx.Audit.Insert(event)
+}
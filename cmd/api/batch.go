@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/validator"
+)
+
+// maxBatchOperations is the maximum number of operations in a batch.
+const maxBatchOperations = 100
+
+// errBatchFailed is returned from the transaction of an all-or-nothing batch when
+// one of its operations fails, so that it is rolled back.
+var errBatchFailed = errors.New("batch operation failed")
+
+// batchOperation is a single change to the catalog in a batch. Create takes the
+// fields of a new book, like createBookHandler; patch takes the id, the version
+// the book is expected to have and the fields to change, like updateBookHandler;
+// delete takes the id and optionally the expected version.
+type batchOperation struct {
+	Op      string          `json:"op"`
+	ID      int64           `json:"id"`
+	Version *int32          `json:"version"`
+	Book    json.RawMessage `json:"book"`
+}
+
+// batchResult is the outcome of an operation, with the HTTP status code which
+// the equivalent single request would have had.
+type batchResult struct {
+	Index  int         `json:"index"`
+	Op     string      `json:"op"`
+	Status int         `json:"status"`
+	Book   *data.Book  `json:"book,omitempty"`
+	Error  interface{} `json:"error,omitempty"`
+}
+
+// batchError is the failure of an operation, given as the status code and the
+// error message of the equivalent single request.
+type batchError struct {
+	status  int
+	message interface{}
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("batch operation failed with status %d", e.status)
+}
+
+// batchBooksHandler applies a list of create, patch and delete operations in a
+// single transaction. By default the batch is all or nothing: if an operation
+// fails, none are applied and the response has the status of the failed one. In
+// partial mode every operation runs in its own savepoint, the failed ones are
+// rolled back and the others are committed.
+func (app *application) batchBooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Partial    bool             `json:"partial"`
+		Operations []batchOperation `json:"operations"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Operations) > 0, "operations", "must contain at least 1 operation")
+	v.Check(len(input.Operations) <= maxBatchOperations, "operations", fmt.Sprintf("must not contain more than %d operations", maxBatchOperations))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	results := make([]*batchResult, len(input.Operations))
+	failed := -1
+
+	err = app.models.Transact(func(tx data.Models) error {
+		for i, op := range input.Operations {
+			var book *data.Book
+			var status int
+
+			apply := func() error {
+				var err error
+				book, status, err = app.applyBatchOperation(tx, r, op)
+				return err
+			}
+
+			var err error
+			if input.Partial {
+				err = tx.Savepoint(apply)
+			} else {
+				err = apply()
+			}
+
+			result := &batchResult{Index: i, Op: op.Op, Status: status, Book: book}
+			results[i] = result
+
+			var opErr *batchError
+			if err != nil {
+				if !errors.As(err, &opErr) {
+					return err
+				}
+
+				result.Status = opErr.status
+				result.Error = opErr.message
+				result.Book = nil
+
+				if !input.Partial {
+					failed = i
+					return errBatchFailed
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBatchFailed) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+
+	if failed >= 0 {
+		status = results[failed].Status
+
+		// Report that nothing was applied, including the operations after the
+		// failed one, which didn't run.
+		for i, op := range input.Operations {
+			if i == failed {
+				continue
+			}
+			results[i] = &batchResult{
+				Index:  i,
+				Op:     op.Op,
+				Status: http.StatusFailedDependency,
+				Error:  fmt.Sprintf("not applied, because operation %d failed", failed),
+			}
+		}
+	}
+
+	env := envelope{"batch": envelope{
+		"partial":   input.Partial,
+		"committed": failed < 0,
+		"results":   results,
+	}}
+
+	err = app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// applyBatchOperation applies an operation with the models of the transaction
+// of the batch and returns the resulting book and status code. The failures of
+// the operation itself are returned as a *batchError; any other error is a
+// server error.
+func (app *application) applyBatchOperation(tx data.Models, r *http.Request, op batchOperation) (*data.Book, int, error) {
+	switch op.Op {
+	case "create":
+		var input bookInput
+
+		err := decodeBatchBook(op.Book, &input)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		book := input.book()
+
+		err = app.saveBatchBook(tx, r, book, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		return book, http.StatusCreated, nil
+
+	case "patch":
+		if op.Version == nil {
+			return nil, 0, &batchError{http.StatusUnprocessableEntity, map[string]string{"version": "must be provided"}}
+		}
+
+		var patch bookPatch
+
+		err := decodeBatchBook(op.Book, &patch)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		book, err := getBatchBook(tx, op)
+		if err != nil {
+			return nil, 0, err
+		}
+		before := *book
+
+		patch.apply(book)
+
+		err = app.saveBatchBook(tx, r, book, &before)
+		if err != nil {
+			return nil, 0, err
+		}
+		return book, http.StatusOK, nil
+
+	case "delete":
+		if !isJSONNull(op.Book) {
+			return nil, 0, &batchError{http.StatusBadRequest, "book must not be provided for delete operations"}
+		}
+
+		book, err := getBatchBook(tx, op)
+		if err != nil {
+			return nil, 0, err
+		}
+		before := *book
+
+		// The delete fails with an edit conflict if the book was changed since it
+		// was read, so the expected version still holds when it is deleted.
+		err = tx.Books.Delete(book)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				return nil, 0, &batchError{http.StatusConflict, "unable to update the record due to an edit conflict, please try again"}
+			default:
+				return nil, 0, err
+			}
+		}
+
+		err = app.recordBookChange(tx, r, "book.deleted", &before, book)
+		if err != nil {
+			return nil, 0, err
+		}
+		return book, http.StatusOK, nil
+
+	default:
+		return nil, 0, &batchError{http.StatusUnprocessableEntity, map[string]string{"op": "must be one of: create, patch, delete"}}
+	}
+}
+
+// decodeBatchBook decodes the book of a create or patch operation, which must be
+// provided and must not contain unknown fields.
+func decodeBatchBook(js json.RawMessage, dst interface{}) error {
+	if isJSONNull(js) {
+		return &batchError{http.StatusBadRequest, "book must be provided"}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		message := "book contains invalid JSON: " + strings.TrimPrefix(err.Error(), "json: ")
+		return &batchError{http.StatusBadRequest, message}
+	}
+	return nil
+}
+
+// isJSONNull reports whether a field of a JSON object was left out or null.
+func isJSONNull(js json.RawMessage) bool {
+	return js == nil || string(js) == "null"
+}
+
+// getBatchBook reads the book of a patch or delete operation and checks that it
+// has the expected version, if one is given.
+func getBatchBook(tx data.Models, op batchOperation) (*data.Book, error) {
+	book, err := tx.Books.Get(op.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, &batchError{http.StatusNotFound, "the requested resource could not be found"}
+		default:
+			return nil, err
+		}
+	}
+
+	if op.Version != nil && *op.Version != book.Version {
+		return nil, &batchError{http.StatusConflict, "unable to update the record due to an edit conflict, please try again"}
+	}
+	return book, nil
+}
+
+// saveBatchBook validates a created or patched book and stores it, recording
+// the change in the audit trail. before is nil for a created book.
+func (app *application) saveBatchBook(tx data.Models, r *http.Request, book *data.Book, before *data.Book) error {
+	v := validator.New()
+
+	if data.ValidateBook(v, book); !v.Valid() {
+		return &batchError{http.StatusUnprocessableEntity, v.Errors}
+	}
+
+	var err error
+	action := "book.created"
+
+	if before == nil {
+		err = tx.Books.Insert(book)
+	} else {
+		action = "book.updated"
+		err = tx.Books.Update(book)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateISBN):
+			return &batchError{http.StatusConflict, map[string]string{"isbn": "a book with this ISBN already exists"}}
+		case errors.Is(err, data.ErrEditConflict):
+			return &batchError{http.StatusConflict, "unable to update the record due to an edit conflict, please try again"}
+		default:
+			return err
+		}
+	}
+
+	return app.recordBookChange(tx, r, action, before, book)
+}
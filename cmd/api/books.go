@@ -4,24 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/isbn"
 	"github.com/barantoraman/GoBookAPI/internal/validator"
 )
 
 // createBookHandler handles the HTTP POST request to create a new book.
 func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request) {
 	// Define a struct to hold the input data from the JSON request.
-	var input struct {
-		ISBN      string     `json:"isbn"`
-		Title     string     `json:"title"`
-		Author    string     `json:"author"`
-		Genres    []string   `json:"genres"`
-		Pages     data.Pages `json:"pages"`
-		Language  string     `json:"language"`
-		Publisher string     `json:"publisher"`
-		Year      int32      `json:"year"`
-	}
+	var input bookInput
 
 	// Read and parse the JSON request body into the input struct.
 	err := app.readJSON(w, r, &input)
@@ -31,16 +25,7 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Create a new Book instance using the input data.
-	book := &data.Book{
-		ISBN:      input.ISBN,
-		Title:     input.Title,
-		Author:    input.Author,
-		Genres:    input.Genres,
-		Pages:     input.Pages,
-		Language:  input.Language,
-		Publisher: input.Publisher,
-		Year:      input.Year,
-	}
+	book := input.book()
 
 	v := validator.New()
 
@@ -50,10 +35,22 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Insert the validated book into the database.
-	err = app.models.Books.Insert(book)
+	// Insert the validated book into the database, recording it in the audit
+	// trail in the same transaction.
+	err = app.models.Transact(func(tx data.Models) error {
+		err := tx.Books.Insert(book)
+		if err != nil {
+			return err
+		}
+		return app.recordBookChange(tx, r, "book.created", nil, book)
+	})
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateISBN):
+			app.duplicateISBNResponse(w, r, book.ISBN)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -77,6 +74,14 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	v := validator.New()
+
+	fields := app.readFields(r.URL.Query(), "fields", data.BookFields, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Retrieve the book from the database.
 	book, err := app.models.Books.Get(id)
 	if err != nil {
@@ -91,8 +96,15 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Reduce the book to the requested fields, if any.
+	sparse, err := app.selectFields(book, fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// Respond with the book data in JSON format.
-	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": sparse}, nil)
 	if err != nil {
 		// Respond with server error if JSON writing fails.
 		app.serverErrorResponse(w, r, err)
@@ -122,17 +134,11 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// Keep a copy of the book as it was, for the audit trail.
+	before := *book
+
 	// Define a struct to hold the updated fields received from the JSON request
-	var input struct {
-		ISBN      *string     `json:"isbn"`
-		Title     *string     `json:"title"`
-		Author    *string     `json:"author"`
-		Genres    []string    `json:"genres"`
-		Pages     *data.Pages `json:"pages"`
-		Language  *string     `json:"language"`
-		Publisher *string     `json:"publisher"`
-		Year      *int32      `json:"year"`
-	}
+	var input bookPatch
 
 	// Decode the JSON request body and update the book fields if values are provided.
 	err = app.readJSON(w, r, &input)
@@ -142,32 +148,7 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Update the book fields with the new values if provided.
-	if input.ISBN != nil {
-		book.ISBN = *input.ISBN
-	}
-	if input.Title != nil {
-		book.Title = *input.Title
-	}
-	if input.Author != nil {
-		book.Author = *input.Author
-	}
-	if input.Genres != nil {
-		book.Genres = input.Genres
-		// we don't need to dereference a slice.
-	}
-	if input.Pages != nil {
-		book.Pages = *input.Pages
-	}
-	if input.Language != nil {
-		book.Language = *input.Language
-	}
-	if input.Publisher != nil {
-		book.Publisher = *input.Publisher
-	}
-
-	if input.Year != nil {
-		book.Year = *input.Year
-	}
+	input.apply(book)
 
 	v := validator.New()
 
@@ -176,10 +157,19 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Update the book record in the database.
-	err = app.models.Books.Update(book)
+	// Update the book record in the database, recording the change in the audit
+	// trail in the same transaction.
+	err = app.models.Transact(func(tx data.Models) error {
+		err := tx.Books.Update(book)
+		if err != nil {
+			return err
+		}
+		return app.recordBookChange(tx, r, "book.updated", &before, book)
+	})
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrDuplicateISBN):
+			app.duplicateISBNResponse(w, r, book.ISBN)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -204,12 +194,27 @@ func (app *application) deleteBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Delete the book record from the database.
-	err = app.models.Books.Delete(id)
+	// Move the book to the trash, recording the change in the audit trail in the
+	// same transaction.
+	err = app.models.Transact(func(tx data.Models) error {
+		book, err := tx.Books.Get(id)
+		if err != nil {
+			return err
+		}
+		before := *book
+
+		err = tx.Books.Delete(book)
+		if err != nil {
+			return err
+		}
+		return app.recordBookChange(tx, r, "book.deleted", &before, book)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -217,7 +222,7 @@ func (app *application) deleteBookHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Respond with a success message in JSON format.
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "book successfully deleted"}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "book successfully moved to the trash"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -227,39 +232,242 @@ func (app *application) deleteBookHandler(w http.ResponseWriter, r *http.Request
 // applies filters and sorting, and sends a JSON response with the results.
 func (app *application) listBooksHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		ISBN   string
-		Title  string
-		Author string
-		Genres []string
-		data.Filters
+		data.BookFilter
+		data.KeysetFilters
+		Facets []string
+		Fields []string
 	}
 
 	v := validator.New()
 
 	qs := r.URL.Query()
 
-	input.ISBN = app.readString(qs, "isbn", "")
-	input.Title = app.readString(qs, "title", "")
-	input.Author = app.readString(qs, "author", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.BookFilter = app.readBookFilter(qs, v)
+
+	input.Facets = app.readCSV(qs, "facets", []string{})
+	for _, facet := range input.Facets {
+		v.Check(validator.In(facet, data.BookFacets...), "facets", "must only contain: "+strings.Join(data.BookFacets, ", "))
+	}
+	v.Check(validator.Unique(input.Facets), "facets", "must not contain duplicate values")
+
+	input.Fields = app.readFields(qs, "fields", data.BookFields, v)
 
-	input.Filters.Cursor = app.readInt(qs, "cursor", 1, v)
-	input.Filters.CursorSize = app.readInt(qs, "cursor_size", 20, v)
+	input.KeysetFilters.Cursor = app.readCursor(qs, "cursor", v)
+	input.KeysetFilters.CursorSize = app.readInt(qs, "cursor_size", 20, v)
 
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafeList = []string{"id", "title", "author", "year", "-id", "-title", "-author", "-year"}
+	input.KeysetFilters.Sort = app.readBookSort(qs, input.BookFilter, v)
+	input.KeysetFilters.SortSafeList = bookSortSafeList
 
-	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+	if total := app.readBool(qs, "total", v); total != nil {
+		input.KeysetFilters.Total = *total
+	}
+
+	if data.ValidateKeysetFilters(v, input.KeysetFilters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	books, metadata, err := app.models.Books.GetAll(input.ISBN, input.Title, input.Author, input.Genres, input.Filters)
+	books, metadata, err := app.models.Books.GetAll(input.BookFilter, input.KeysetFilters, input.Fields)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			v.AddError("cursor", "is invalid")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Reduce the books to the requested fields, if any.
+	sparse := make([]interface{}, len(books))
+	for i, book := range books {
+		sparse[i], err = app.selectFields(book, input.Fields)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelope{"books": sparse, "metadata": metadata}
+
+	// Facets are counted over every matching book, not only those of the page.
+	if len(input.Facets) > 0 {
+		facets, err := app.models.Books.GetFacets(input.BookFilter, input.Facets)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env["facets"] = facets
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// bookSortSafeList holds the sort values accepted when listing or exporting books.
+var bookSortSafeList = []string{"id", "title", "author", "year", "relevance", "-id", "-title", "-author", "-year", "-relevance"}
+
+// readBookFilter reads the filters for listing or exporting books from the query
+// string.
+func (app *application) readBookFilter(qs url.Values, v *validator.Validator) data.BookFilter {
+	var filter data.BookFilter
+
+	filter.ISBN = app.readString(qs, "isbn", "")
+	if filter.ISBN != "" {
+		// Accept either form of the ISBN, as books are stored with the ISBN-13.
+		canonical, err := isbn.Normalize(filter.ISBN)
+		if err != nil {
+			v.AddError("isbn", "must be a valid ISBN-10 or ISBN-13")
+		}
+		filter.ISBN = canonical
+	}
+	filter.Title = app.readString(qs, "title", "")
+	filter.Author = app.readString(qs, "author", "")
+	filter.Genres = app.readCSV(qs, "genres", []string{})
+	// Publisher names may contain commas, so the languages and publishers to
+	// match are given as repeated parameters instead.
+	filter.Languages = app.readStrings(qs, "language", []string{})
+	filter.Publishers = app.readStrings(qs, "publisher", []string{})
+
+	genresMode := app.readString(qs, "genres_mode", "all")
+	v.Check(validator.In(genresMode, "all", "any"), "genres_mode", "must be either all or any")
+	filter.GenresAny = genresMode == "any"
+
+	filter.YearMin = app.readOptionalInt(qs, "year_min", v)
+	filter.YearMax = app.readOptionalInt(qs, "year_max", v)
+	filter.PagesMin = app.readOptionalInt(qs, "pages_min", v)
+	filter.PagesMax = app.readOptionalInt(qs, "pages_max", v)
+	filter.CreatedAfter = app.readTime(qs, "created_after", v)
+	filter.CreatedBefore = app.readTime(qs, "created_before", v)
+
+	filter.Query = strings.TrimSpace(app.readString(qs, "q", ""))
+	filter.QueryLanguage = app.readString(qs, "q_language", "")
+	v.Check(len(filter.Query) <= 500, "q", "must not be more than 500 bytes long")
+	v.Check(len(filter.QueryLanguage) <= 50, "q_language", "must not be more than 50 bytes long")
+
+	mode := app.readString(qs, "q_mode", "fulltext")
+	v.Check(validator.In(mode, "fulltext", "fuzzy"), "q_mode", "must be either fulltext or fuzzy")
+	filter.Fuzzy = mode == "fuzzy"
+
+	data.ValidateBookFilter(v, filter)
+
+	return filter
+}
+
+// readBookSort reads the sort for listing or exporting books from the query
+// string. Searches are sorted by relevance, most relevant first, by default,
+// and only searches can be.
+func (app *application) readBookSort(qs url.Values, filter data.BookFilter, v *validator.Validator) string {
+	sort := "id"
+	if filter.Query != "" {
+		sort = "-relevance"
+	}
+	sort = app.readString(qs, "sort", sort)
+
+	if strings.TrimPrefix(sort, "-") == "relevance" {
+		v.Check(filter.Query != "", "sort", "relevance needs a search with q")
+	}
+	return sort
+}
+
+// bookInput holds the fields of a new book, as sent to createBookHandler.
+type bookInput struct {
+	ISBN      string     `json:"isbn"`
+	Title     string     `json:"title"`
+	Author    string     `json:"author"`
+	Genres    []string   `json:"genres"`
+	Pages     data.Pages `json:"pages"`
+	Language  string     `json:"language"`
+	Publisher string     `json:"publisher"`
+	Year      int32      `json:"year"`
+}
+
+// book returns a new Book with the fields of the input.
+func (input bookInput) book() *data.Book {
+	return &data.Book{
+		ISBN:      input.ISBN,
+		Title:     input.Title,
+		Author:    input.Author,
+		Genres:    input.Genres,
+		Pages:     input.Pages,
+		Language:  input.Language,
+		Publisher: input.Publisher,
+		Year:      input.Year,
+	}
+}
+
+// bookPatch holds the fields of a book to update, as sent to updateBookHandler.
+// The fields which are not provided are nil.
+type bookPatch struct {
+	ISBN      *string     `json:"isbn"`
+	Title     *string     `json:"title"`
+	Author    *string     `json:"author"`
+	Genres    []string    `json:"genres"`
+	Pages     *data.Pages `json:"pages"`
+	Language  *string     `json:"language"`
+	Publisher *string     `json:"publisher"`
+	Year      *int32      `json:"year"`
+}
+
+// apply updates the fields of the book with the values which are provided.
+func (patch bookPatch) apply(book *data.Book) {
+	if patch.ISBN != nil {
+		book.ISBN = *patch.ISBN
+	}
+	if patch.Title != nil {
+		book.Title = *patch.Title
+	}
+	if patch.Author != nil {
+		book.Author = *patch.Author
+	}
+	if patch.Genres != nil {
+		book.Genres = patch.Genres
+		// we don't need to dereference a slice.
+	}
+	if patch.Pages != nil {
+		book.Pages = *patch.Pages
+	}
+	if patch.Language != nil {
+		book.Language = *patch.Language
+	}
+	if patch.Publisher != nil {
+		book.Publisher = *patch.Publisher
+	}
+	if patch.Year != nil {
+		book.Year = *patch.Year
+	}
+}
+
+// suggestBooksHandler completes what a user is typing into a search box with the
+// titles and authors of books.
+func (app *application) suggestBooksHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	prefix := strings.TrimSpace(app.readString(qs, "prefix", ""))
+	limit := app.readInt(qs, "limit", 10, v)
+
+	v.Check(prefix != "", "prefix", "must be provided")
+	v.Check(len(prefix) <= 100, "prefix", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"books": books, "metadata": metadata}, nil)
+
+	suggestions, err := app.models.Books.Suggest(prefix, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
 
 	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/jwt"
 )
 
 type contextKey string
@@ -13,6 +15,24 @@ type contextKey string
 // constant for managing user information within the request context.
 const userContextKey = contextKey("user")
 
+// tokenContextKey is used to store the bearer token the request was
+// authenticated with.
+const tokenContextKey = contextKey("token")
+
+// apiKeyContextKey is used to store the API key the request was authenticated
+// with.
+const apiKeyContextKey = contextKey("api_key")
+
+// claimsContextKey is used to store the verified claims of a signed access
+// token when running in JWT mode.
+const claimsContextKey = contextKey("claims")
+
+// requestIDContextKey is used to store the ID of the request.
+const requestIDContextKey = contextKey("request_id")
+
+// connContextKey is used to store the connection a request was received on.
+const connContextKey = contextKey("conn")
+
 // contextSetUser() creates a fresh request copy embedded with the given User struct
 // within the context, utilizing the userContextKey constant for referencing.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
@@ -28,3 +48,87 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// contextSetToken() returns a new request copy with the given token stored in
+// the context.
+func (app *application) contextSetToken(r *http.Request, token *data.Token) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken() retrieves the token the request was authenticated with. It
+// returns nil when the request was not authenticated with a bearer token.
+func (app *application) contextGetToken(r *http.Request) *data.Token {
+	token, ok := r.Context().Value(tokenContextKey).(*data.Token)
+	if !ok {
+		return nil
+	}
+	return token
+}
+
+// contextSetAPIKey() returns a new request copy with the given API key stored in
+// the context.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey() retrieves the API key the request was authenticated with.
+// It returns nil when the request was not authenticated with an API key.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	if !ok {
+		return nil
+	}
+	return key
+}
+
+// contextSetClaims() returns a new request copy with the given JWT claims stored
+// in the context.
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// contextGetClaims() retrieves the JWT claims the request was authenticated
+// with. It returns nil when the request was not authenticated with a JWT.
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, ok := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	if !ok {
+		return nil
+	}
+	return claims
+}
+
+// contextSetRequestID() returns a new request copy with the given request ID
+// stored in the context.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID() retrieves the ID of the request. It returns an empty
+// string when the request has no ID.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, ok := r.Context().Value(requestIDContextKey).(string)
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// contextSetConn() returns a copy of the context of a new connection with the
+// connection stored in it. It is used as the ConnContext of the server.
+func (app *application) contextSetConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey, conn)
+}
+
+// contextGetConn() retrieves the connection the request was received on. It
+// returns nil when the connection wasn't stored.
+func (app *application) contextGetConn(r *http.Request) net.Conn {
+	conn, ok := r.Context().Value(connContextKey).(net.Conn)
+	if !ok {
+		return nil
+	}
+	return conn
+}
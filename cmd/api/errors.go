@@ -1,13 +1,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barantoraman/GoBookAPI/internal/data"
 )
 
 // The logError() method is a generic helper for logging an error message.
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
+		"request_id":     app.contextGetRequestID(r),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
@@ -58,6 +66,12 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) loginLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -65,10 +79,21 @@ func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *htt
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.Header().Add("WWW-Authenticate", "ApiKey")
 	message := "invalid or missing authentication token"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidOTPResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or already used two-factor authentication code"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -78,3 +103,66 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	message := "your user account must be activated to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) totpAlreadyEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is already enabled for this account"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// duplicateISBNResponse reports that another book already has the ISBN, with a
+// link to that book when it can be found.
+func (app *application) duplicateISBNResponse(w http.ResponseWriter, r *http.Request, isbn string) {
+	message := map[string]string{"isbn": "a book with this ISBN already exists"}
+
+	headers := make(http.Header)
+
+	id, err := app.models.Books.GetIDByISBN(isbn)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.logError(r, err)
+	}
+	if err == nil {
+		message["existing_book"] = fmt.Sprintf("/v1/books/%d", id)
+		headers.Set("Link", fmt.Sprintf(`</v1/books/%d>; rel="duplicate"`, id))
+	}
+
+	err = app.writeJSON(w, http.StatusConflict, envelope{"error": message}, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, supported ...string) {
+	message := fmt.Sprintf("the Content-Type must be one of: %s", strings.Join(supported, ", "))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+// importFailedResponse reports an error which stopped an import part-way,
+// together with the report of the rows read before it.
+func (app *application) importFailedResponse(w http.ResponseWriter, r *http.Request, err error, report interface{}) {
+	env := envelope{"error": err.Error(), "import": report}
+	err = app.writeJSON(w, http.StatusBadRequest, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
+// importServerErrorResponse is like serverErrorResponse, but for an import which
+// has stored some of its batches. The report tells the client which rows were
+// created, so that the rest can be retried.
+func (app *application) importServerErrorResponse(w http.ResponseWriter, r *http.Request, err error, report interface{}) {
+	app.logError(r, err)
+	message := "the server encountered a problem and could not process your request"
+	env := envelope{"error": message, "import": report}
+	err = app.writeJSON(w, http.StatusInternalServerError, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/validator"
+)
+
+// exportFormat describes one of the formats of a book export.
+type exportFormat struct {
+	mediaType  string
+	extension  string
+	newEncoder func(w io.Writer) bookEncoder
+}
+
+// exportFormats maps the values of the format query parameter to the formats.
+var exportFormats = map[string]exportFormat{
+	"csv": {
+		mediaType:  "text/csv",
+		extension:  "csv",
+		newEncoder: func(w io.Writer) bookEncoder { return &csvBookEncoder{writer: csv.NewWriter(w)} },
+	},
+	"ndjson": {
+		mediaType:  "application/x-ndjson",
+		extension:  "ndjson",
+		newEncoder: func(w io.Writer) bookEncoder { return &ndjsonBookEncoder{encoder: json.NewEncoder(w)} },
+	},
+	"json": {
+		mediaType:  "application/json",
+		extension:  "json",
+		newEncoder: func(w io.Writer) bookEncoder { return &jsonBookEncoder{w: w} },
+	},
+}
+
+// exportFormatNames are the names of the formats, in the order in which they are
+// offered.
+var exportFormatNames = []string{"json", "ndjson", "csv"}
+
+// exportBooksHandler streams every book matching the filters of listBooksHandler,
+// without paginating them. The format is chosen with ?format= or else the Accept
+// header, and defaults to JSON. The response is gzipped if the client accepts it.
+// The export may take longer than the write timeout of the server, so it is
+// limited by the export timeout instead, and stops if the client goes away.
+func (app *application) exportBooksHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filter := app.readBookFilter(qs, v)
+
+	filters := data.Filters{
+		Sort:         app.readBookSort(qs, filter, v),
+		SortSafeList: bookSortSafeList,
+	}
+	v.Check(validator.In(filters.Sort, filters.SortSafeList...), "sort", "invalid sort value")
+
+	name := app.readString(qs, "format", app.negotiateExportFormat(r))
+	format, ok := exportFormats[name]
+	v.Check(ok, "format", "must be one of: "+strings.Join(exportFormatNames, ", "))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	filename := fmt.Sprintf("books-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format.extension)
+
+	w.Header().Add("Vary", "Accept")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Content-Type", format.mediaType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	// Nothing is sent until the encoders write to out, so that an error from the
+	// query can still be sent as an error response.
+	out := &exportWriter{w: w}
+
+	var dst io.Writer = out
+	var gz *gzip.Writer
+
+	if app.acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(out)
+		dst = gz
+	}
+
+	encoder := format.newEncoder(dst)
+
+	ctx := r.Context()
+	deadline := time.Time{}
+
+	if app.config.exports.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, app.config.exports.timeout)
+		defer cancel()
+
+		deadline, _ = ctx.Deadline()
+	}
+
+	// Replace the write deadline which the server set for the connection, so
+	// that the export isn't cut off by it. A zero deadline disables it. The
+	// server only speaks HTTP/1.x, so the connection serves this request alone.
+	if conn := app.contextGetConn(r); conn != nil {
+		err := conn.SetWriteDeadline(deadline)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.models.Books.Export(ctx, filter, filters, encoder.Encode)
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		if !out.started {
+			for _, header := range []string{"Vary", "Content-Type", "Content-Disposition", "Content-Encoding"} {
+				w.Header().Del(header)
+			}
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Part of the export has been sent, and the status can't be changed any
+		// more. Abort the response, so that the client sees that it is incomplete
+		// rather than a shorter export: the connection is closed without the end
+		// of the chunked body.
+		app.logError(r, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// negotiateExportFormat returns the name of the export format preferred by the
+// Accept header of the request, or json if it doesn't accept any of them.
+func (app *application) negotiateExportFormat(r *http.Request) string {
+	for _, mediaType := range app.acceptedValues(r.Header.Get("Accept")) {
+		for _, name := range exportFormatNames {
+			if mediaType == exportFormats[name].mediaType {
+				return name
+			}
+		}
+	}
+	return "json"
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of the request accepts
+// gzip.
+func (app *application) acceptsGzip(r *http.Request) bool {
+	for _, encoding := range app.acceptedValues(r.Header.Get("Accept-Encoding")) {
+		if encoding == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// exportWriter records whether anything was written to the response.
+type exportWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (ew *exportWriter) Write(p []byte) (int, error) {
+	ew.started = true
+	return ew.w.Write(p)
+}
+
+// bookEncoder writes books in one of the export formats. Close finishes the
+// export and must be called even if no books were encoded.
+type bookEncoder interface {
+	Encode(book *data.Book) error
+	Close() error
+}
+
+// csvBookEncoder writes a header row and then one row per book. Genres are
+// separated by semicolons, like in an import.
+type csvBookEncoder struct {
+	writer      *csv.Writer
+	wroteHeader bool
+}
+
+func (e *csvBookEncoder) writeHeader() error {
+	if e.wroteHeader {
+		return nil
+	}
+	e.wroteHeader = true
+
+	return e.writer.Write([]string{"id", "isbn", "title", "author", "genres", "pages", "language", "publisher", "year", "version"})
+}
+
+func (e *csvBookEncoder) Encode(book *data.Book) error {
+	err := e.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	return e.writer.Write([]string{
+		strconv.FormatInt(book.ID, 10),
+		book.ISBN,
+		book.Title,
+		book.Author,
+		strings.Join(book.Genres, ";"),
+		strconv.FormatInt(int64(book.Pages), 10),
+		book.Language,
+		book.Publisher,
+		strconv.FormatInt(int64(book.Year), 10),
+		strconv.FormatInt(int64(book.Version), 10),
+	})
+}
+
+func (e *csvBookEncoder) Close() error {
+	err := e.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// ndjsonBookEncoder writes every book as a JSON object on its own line.
+type ndjsonBookEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonBookEncoder) Encode(book *data.Book) error {
+	return e.encoder.Encode(book)
+}
+
+func (e *ndjsonBookEncoder) Close() error {
+	return nil
+}
+
+// jsonBookEncoder writes the books as an array in a {"books": [...]} envelope,
+// like listBooksHandler but without the metadata.
+type jsonBookEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonBookEncoder) Encode(book *data.Book) error {
+	js, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+
+	prefix := ","
+	if e.count == 0 {
+		prefix = `{"books":[`
+	}
+	e.count++
+
+	_, err = io.WriteString(e.w, prefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(js)
+	return err
+}
+
+func (e *jsonBookEncoder) Close() error {
+	suffix := "]}\n"
+	if e.count == 0 {
+		suffix = `{"books":[]}` + "\n"
+	}
+
+	_, err := io.WriteString(e.w, suffix)
+	return err
+}
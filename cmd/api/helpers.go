@@ -5,11 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/barantoraman/GoBookAPI/internal/data"
 	"github.com/barantoraman/GoBookAPI/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -28,6 +32,19 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// readVersionParam extracts and validates the version parameter of book
+// revision routes from the request's context.
+func (app *application) readVersionParam(r *http.Request) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid version parameter")
+	}
+
+	return int32(version), nil
+}
+
 // writeJSON marshals data to JSON format, sets response headers, writes status, and sends JSON response.
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	js, err := json.MarshalIndent(data, "", "\t")
@@ -128,6 +145,24 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 	return strings.Split(csv, ",")
 }
 
+// This helper function retrieves every value of a repeated key in the query
+// string, as in ?publisher=a&publisher=b, so that the values may contain commas.
+// Empty values are skipped, and it returns a default value if none are left.
+func (app *application) readStrings(qs url.Values, key string, defaultValue []string) []string {
+	var values []string
+
+	for _, s := range qs[key] {
+		if s != "" {
+			values = append(values, s)
+		}
+	}
+	if len(values) == 0 {
+		return defaultValue
+	}
+
+	return values
+}
+
 // This helper function retrieves an integer value from the query string, with error
 // handling for invalid inputs. It records validation errors and returns a default value
 // if the key is missing or the conversion fails.
@@ -145,3 +180,198 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 
 	return i
 }
+
+// This helper function retrieves an optional integer value from the query string,
+// with error handling. It returns nil if the key is not present.
+func (app *application) readOptionalInt(qs url.Values, key string, v *validator.Validator) *int {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return nil
+	}
+
+	return &i
+}
+
+// This helper function retrieves a boolean value from the query string, with
+// error handling. It returns nil if the key is not present.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// This helper function retrieves a time from the query string, given either as
+// an RFC 3339 timestamp or as a date. It returns nil if the key is not present.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return &t
+		}
+	}
+
+	v.AddError(key, "must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	return nil
+}
+
+// This helper function retrieves a sparse fieldset from the query string: the
+// comma-separated names of the fields to include in a response, which must all
+// be in the safelist. Spaces around the names are ignored. It returns nil if the
+// key is missing.
+func (app *application) readFields(qs url.Values, key string, safeList []string, v *validator.Validator) []string {
+	fields := app.readCSV(qs, key, nil)
+
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		fields[i] = field
+
+		if !validator.In(field, safeList...) {
+			v.AddError(key, fmt.Sprintf("unknown field %q, must be one of: %s", field, strings.Join(safeList, ", ")))
+			return nil
+		}
+	}
+
+	return fields
+}
+
+// The selectFields() helper reduces the JSON object of a value to the given
+// fields, for sparse fieldsets. It returns the value itself if no fields are
+// given.
+func (app *application) selectFields(value interface{}, fields []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return value, nil
+	}
+
+	js, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]json.RawMessage
+
+	err = json.Unmarshal(js, &object)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := object[field]; ok {
+			selected[field] = value
+		}
+	}
+
+	return selected, nil
+}
+
+// This helper function retrieves a pagination cursor from the query string. It
+// returns nil if the key is not present.
+func (app *application) readCursor(qs url.Values, key string, v *validator.Validator) *data.Cursor {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	cursor, err := data.ParseCursor(s)
+	if err != nil {
+		v.AddError(key, "is invalid")
+		return nil
+	}
+
+	return cursor
+}
+
+// The background() helper runs the given function in a background goroutine,
+// recovering from any panic and tracking it in the application's WaitGroup so
+// that graceful shutdown waits for it.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// The clientIP() helper returns the IP address of the client which sent the
+// request.
+func (app *application) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// The acceptedValues() helper parses a header like Accept or Accept-Encoding into
+// its values, most preferred first. Values with a quality of 0 are left out, and
+// values with the same quality keep their order.
+func (app *application) acceptedValues(header string) []string {
+	type accepted struct {
+		value   string
+		quality float64
+	}
+
+	var values []accepted
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if quality > 0 {
+			values = append(values, accepted{value, quality})
+		}
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].quality > values[j].quality
+	})
+
+	result := make([]string, len(values))
+	for i, v := range values {
+		result[i] = v.value
+	}
+	return result
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/validator"
+)
+
+// importBatchSize is the number of valid rows inserted per transaction.
+const importBatchSize = 1000
+
+// errDryRun is returned from the import transactions of a dry run, so that they
+// are rolled back.
+var errDryRun = errors.New("dry run")
+
+// Statuses of the rows in an import report.
+const (
+	importCreated   = "created"
+	importValid     = "valid"
+	importInvalid   = "invalid"
+	importDuplicate = "duplicate"
+	importFailed    = "failed"
+)
+
+// importRowResult is the outcome of a single row of an import.
+type importRowResult struct {
+	Row    int               `json:"row"`
+	Status string            `json:"status"`
+	ID     int64             `json:"id,omitempty"`
+	ISBN   string            `json:"isbn,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// importReport is the response of an import.
+type importReport struct {
+	DryRun  bool               `json:"dry_run"`
+	Total   int                `json:"total"`
+	Created int                `json:"created"`
+	Failed  int                `json:"failed"`
+	Rows    []*importRowResult `json:"rows"`
+}
+
+// bookRowReader reads the books of an import one row at a time. A malformed row
+// is reported through rowErr, and reading may go on; err is only set at the end
+// of the input (io.EOF) or when the input can't be read any further.
+type bookRowReader interface {
+	Read() (book *data.Book, rowErr error, err error)
+}
+
+// importBooksHandler creates books from a CSV or NDJSON request body. Every row is
+// validated like a book sent to createBookHandler, the valid rows are inserted
+// in batches, each in its own transaction, and the response reports the outcome
+// of every row. With ?dry_run=true the batches are rolled back instead, so the
+// report shows what an import would do, duplicate ISBNs included.
+func (app *application) importBooksHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	dryRun := app.readBool(r.URL.Query(), "dry_run", v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.imports.maxBytes)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var reader bookRowReader
+	var err error
+
+	switch mediaType {
+	case "text/csv":
+		reader, err = newCSVBookReader(r.Body)
+	case "application/x-ndjson", "application/jsonl":
+		reader = newNDJSONBookReader(r.Body)
+	default:
+		app.unsupportedMediaTypeResponse(w, r, "text/csv", "application/x-ndjson")
+		return
+	}
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	report := &importReport{
+		DryRun: dryRun != nil && *dryRun,
+		Rows:   []*importRowResult{},
+	}
+
+	// seen maps the ISBNs of the valid rows to their row numbers, to report
+	// duplicates within the input before they reach the database.
+	seen := map[string]int{}
+
+	var batch []*data.Book
+	var batchResults []*importRowResult
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := app.importBatch(r, batch, batchResults, report.DryRun)
+		batch, batchResults = nil, nil
+		return err
+	}
+
+	for row := 1; ; row++ {
+		book, rowErr, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Report the rows up to the error; the batches before it are kept.
+			flushErr := flush()
+			if flushErr != nil {
+				report.summarize()
+				app.importServerErrorResponse(w, r, flushErr, report)
+				return
+			}
+			report.summarize()
+			app.importFailedResponse(w, r, err, report)
+			return
+		}
+
+		result := &importRowResult{Row: row}
+		report.Rows = append(report.Rows, result)
+
+		if rowErr != nil {
+			result.Status = importInvalid
+			result.Errors = map[string]string{"row": rowErr.Error()}
+			continue
+		}
+
+		v := validator.New()
+
+		if data.ValidateBook(v, book); !v.Valid() {
+			result.Status = importInvalid
+			result.ISBN = book.ISBN
+			result.Errors = v.Errors
+			continue
+		}
+
+		result.ISBN = book.ISBN
+
+		if first, ok := seen[book.ISBN]; ok {
+			result.Status = importDuplicate
+			result.Errors = map[string]string{"isbn": fmt.Sprintf("duplicates the ISBN of row %d", first)}
+			continue
+		}
+		seen[book.ISBN] = row
+
+		batch = append(batch, book)
+		batchResults = append(batchResults, result)
+
+		if len(batch) == importBatchSize {
+			err = flush()
+			if err != nil {
+				report.summarize()
+				app.importServerErrorResponse(w, r, err, report)
+				return
+			}
+		}
+	}
+
+	err = flush()
+	if err != nil {
+		report.summarize()
+		app.importServerErrorResponse(w, r, err, report)
+		return
+	}
+
+	report.summarize()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"import": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// importBatch inserts a batch of valid books in a single transaction, along with
+// their audit events, and fills in the results of their rows. A dry run rolls
+// the transaction back. If the transaction fails, the rows of the batch are
+// reported as failed, as none of them were stored.
+func (app *application) importBatch(r *http.Request, books []*data.Book, results []*importRowResult, dryRun bool) error {
+	err := app.models.Transact(func(tx data.Models) error {
+		err := tx.Books.InsertMany(books)
+		if err != nil {
+			return err
+		}
+
+		var events []*data.AuditEvent
+
+		for _, book := range books {
+			if book.ID == 0 {
+				continue
+			}
+
+			event := app.newAuditEvent(r, "book.imported", data.AuditTargetBook, book.ID)
+
+			err = event.SetChanges(nil, book)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+
+		err = tx.Audit.InsertMany(events)
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		for _, result := range results {
+			result.Status = importFailed
+			result.Errors = map[string]string{"row": "was not stored, because the import stopped"}
+		}
+		return err
+	}
+
+	for i, book := range books {
+		switch {
+		case book.ID == 0:
+			results[i].Status = importDuplicate
+			results[i].Errors = map[string]string{"isbn": "a book with this ISBN already exists"}
+		case dryRun:
+			results[i].Status = importValid
+		default:
+			results[i].Status = importCreated
+			results[i].ID = book.ID
+		}
+	}
+	return nil
+}
+
+// summarize counts the rows of the report by outcome.
+func (report *importReport) summarize() {
+	report.Total = len(report.Rows)
+	report.Created, report.Failed = 0, 0
+
+	for _, result := range report.Rows {
+		switch result.Status {
+		case importCreated, importValid:
+			report.Created++
+		default:
+			report.Failed++
+		}
+	}
+}
+
+// csvBookReader reads books from CSV with a header row naming the columns. The
+// genres are separated by semicolons and pages is a plain number.
+type csvBookReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+// csvBookColumns are the columns which the header row of a CSV import must have.
+var csvBookColumns = []string{"isbn", "title", "author", "genres", "pages", "language", "publisher", "year"}
+
+func newCSVBookReader(r io.Reader) (*csvBookReader, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("body must not be empty")
+		}
+		return nil, importReadError(err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !validator.In(name, csvBookColumns...) {
+			return nil, fmt.Errorf("header contains unknown column %q", name)
+		}
+		columns[name] = i
+	}
+	for _, name := range csvBookColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("header is missing the %q column", name)
+		}
+	}
+
+	return &csvBookReader{reader: reader, columns: columns}, nil
+}
+
+func (cr *csvBookReader) Read() (*data.Book, error, error) {
+	record, err := cr.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, parseErr.Err, nil
+		}
+		return nil, nil, importReadError(err)
+	}
+
+	field := func(name string) string {
+		return strings.TrimSpace(record[cr.columns[name]])
+	}
+
+	book := &data.Book{
+		ISBN:      field("isbn"),
+		Title:     field("title"),
+		Author:    field("author"),
+		Language:  field("language"),
+		Publisher: field("publisher"),
+	}
+
+	book.Genres = []string{}
+	for _, genre := range strings.Split(field("genres"), ";") {
+		if genre = strings.TrimSpace(genre); genre != "" {
+			book.Genres = append(book.Genres, genre)
+		}
+	}
+
+	if s := field("pages"); s != "" {
+		pages, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return nil, errors.New("pages must be an integer value"), nil
+		}
+		book.Pages = data.Pages(pages)
+	}
+
+	if s := field("year"); s != "" {
+		year, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return nil, errors.New("year must be an integer value"), nil
+		}
+		book.Year = int32(year)
+	}
+
+	return book, nil, nil
+}
+
+// ndjsonBookReader reads books from newline-delimited JSON, with one object per
+// line in the same format as the body of createBookHandler. Blank lines are
+// skipped.
+type ndjsonBookReader struct {
+	scanner *bufio.Scanner
+}
+
+func newNDJSONBookReader(r io.Reader) *ndjsonBookReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1_048_576)
+
+	return &ndjsonBookReader{scanner: scanner}
+}
+
+func (nr *ndjsonBookReader) Read() (*data.Book, error, error) {
+	var line []byte
+
+	for len(line) == 0 {
+		if !nr.scanner.Scan() {
+			if err := nr.scanner.Err(); err != nil {
+				return nil, nil, importReadError(err)
+			}
+			return nil, nil, io.EOF
+		}
+		line = bytes.TrimSpace(nr.scanner.Bytes())
+	}
+
+	var input bookInput
+
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(&input)
+	if err != nil {
+		return nil, fmt.Errorf("line contains invalid JSON: %s", strings.TrimPrefix(err.Error(), "json: ")), nil
+	}
+
+	return input.book(), nil, nil
+}
+
+// importReadError translates the errors which stop an import into messages for
+// the client.
+func importReadError(err error) error {
+	switch {
+	case err.Error() == "http: request body too large":
+		return errors.New("body is too large")
+	case errors.Is(err, bufio.ErrTooLong):
+		return errors.New("body contains a line longer than 1MB")
+	default:
+		return err
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/validator"
+)
+
+// loginKeys returns the login throttle keys for the account and the client IP
+// address of a login attempt.
+func (app *application) loginKeys(r *http.Request, email string) (accountKey, ipKey string) {
+	return "email:" + strings.ToLower(email), "ip:" + app.clientIP(r)
+}
+
+// checkLoginLockout sends a too many requests response and returns false if the
+// account or the client IP address of a login attempt is locked.
+func (app *application) checkLoginLockout(w http.ResponseWriter, r *http.Request, email string) bool {
+	accountKey, ipKey := app.loginKeys(r, email)
+
+	lockedUntil, err := app.models.LoginThrottles.LockedUntil(accountKey, ipKey)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !lockedUntil.IsZero() {
+		app.loginLockedResponse(w, r, time.Until(lockedUntil))
+		return false
+	}
+	return true
+}
+
+// recordLoginFailure counts a failed login attempt against both the account and
+// the client IP address, and locks whichever of them reached its threshold.
+// Every further failure doubles the lockout, up to the configured maximum.
+func (app *application) recordLoginFailure(r *http.Request, email string) error {
+	accountKey, ipKey := app.loginKeys(r, email)
+
+	thresholds := map[string]int{
+		accountKey: app.config.lockout.accountThreshold,
+		ipKey:      app.config.lockout.ipThreshold,
+	}
+
+	for key, threshold := range thresholds {
+		failures, err := app.models.LoginThrottles.RecordFailure(key, app.config.lockout.window)
+		if err != nil {
+			return err
+		}
+
+		if failures < threshold {
+			continue
+		}
+
+		duration := app.config.lockout.max
+		if shift := failures - threshold; shift < 32 {
+			if d := app.config.lockout.base << shift; d > 0 && d < duration {
+				duration = d
+			}
+		}
+		lockedUntil := time.Now().Add(duration)
+
+		err = app.models.LoginThrottles.Lock(key, lockedUntil)
+		if err != nil {
+			return err
+		}
+
+		app.logger.PrintInfo("login locked", map[string]string{
+			"event":        "login_locked",
+			"key":          key,
+			"email":        email,
+			"ip":           app.clientIP(r),
+			"failures":     strconv.Itoa(failures),
+			"locked_until": lockedUntil.UTC().Format(time.RFC3339),
+		})
+	}
+	return nil
+}
+
+// resetLoginFailures clears the failures of an account after a successful login.
+// The failures of the client IP address are kept, as many users may share it.
+func (app *application) resetLoginFailures(r *http.Request, email string) error {
+	accountKey, _ := app.loginKeys(r, email)
+
+	err := app.models.LoginThrottles.Reset(accountKey)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return err
+	}
+	return nil
+}
+
+// listLoginLockoutsHandler lists the accounts and IP addresses which are
+// currently locked.
+func (app *application) listLoginLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := app.models.LoginThrottles.GetAllLocked()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"lockouts": lockouts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteLoginLockoutHandler lets an administrator unlock an account or an IP
+// address before the lockout expires.
+func (app *application) deleteLoginLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+		IP    string `json:"ip"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Email != "" || input.IP != "", "email", "either email or ip must be provided")
+	v.Check(input.Email == "" || input.IP == "", "email", "only one of email or ip may be provided")
+	if input.Email != "" {
+		data.ValidateEmail(v, input.Email)
+	}
+	if input.IP != "" {
+		v.Check(net.ParseIP(input.IP) != nil, "ip", "must be a valid IP address")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	key := "ip:" + input.IP
+	if input.Email != "" {
+		key = "email:" + strings.ToLower(input.Email)
+	}
+
+	err = app.models.LoginThrottles.Reset(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	app.logger.PrintInfo("login unlocked", map[string]string{
+		"event":    "login_unlocked",
+		"key":      key,
+		"actor_id": strconv.FormatInt(admin.ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "lockout successfully removed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -5,13 +5,17 @@ import (
 	"database/sql"
 	"expvar"
 	"flag"
+	"fmt"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/barantoraman/GoBookAPI/internal/data"
 	"github.com/barantoraman/GoBookAPI/internal/jsonlog"
+	"github.com/barantoraman/GoBookAPI/internal/jwt"
+	"github.com/barantoraman/GoBookAPI/internal/mailer"
 	_ "github.com/lib/pq"
 )
 
@@ -33,16 +37,60 @@ type config struct {
 		burst   int
 		enabled bool
 	}
+	lockout struct {
+		accountThreshold int
+		ipThreshold      int
+		window           time.Duration
+		base             time.Duration
+		max              time.Duration
+	}
 	cors struct {
 		trustedOrigins []string
 	}
+	mailer struct {
+		transport string
+		dir       string
+		sender    string
+	}
+	tokens struct {
+		mode       string
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	jwt struct {
+		keys     []string
+		issuer   string
+		denylist bool
+	}
+	permissions struct {
+		defaults []string
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+	}
+	imports struct {
+		maxBytes int64
+	}
+	exports struct {
+		timeout time.Duration
+	}
+	trash struct {
+		retention     time.Duration
+		purgeInterval time.Duration
+	}
 }
 
 // Define an application struct to hold the dependencies
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
+	config  config
+	logger  *jsonlog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	jwtKeys *jwt.KeySet
+	wg      sync.WaitGroup
 }
 
 func main() {
@@ -62,6 +110,44 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
+	flag.StringVar(&cfg.tokens.mode, "token-mode", "stateful", "Access token mode (stateful|jwt)")
+	flag.IntVar(&cfg.lockout.accountThreshold, "lockout-account-threshold", 5, "Failed logins per account before it is locked")
+	flag.IntVar(&cfg.lockout.ipThreshold, "lockout-ip-threshold", 20, "Failed logins per IP address before it is locked")
+	flag.DurationVar(&cfg.lockout.window, "lockout-window", 15*time.Minute, "Time without failures after which the failure count starts over")
+	flag.DurationVar(&cfg.lockout.base, "lockout-base", time.Minute, "Lockout duration at the threshold, doubled for every further failure")
+	flag.DurationVar(&cfg.lockout.max, "lockout-max", time.Hour, "Maximum lockout duration")
+
+	flag.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "Lifetime of access tokens")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+
+	flag.Func("jwt-keys", "JWT keys as kid:alg:base64 (space separated, the first one signs)", func(val string) error {
+		cfg.jwt.keys = strings.Fields(val)
+		return nil
+	})
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "gobookapi", "JWT issuer")
+	flag.BoolVar(&cfg.jwt.denylist, "jwt-denylist", false, "Check JWTs against the revocation denylist")
+
+	flag.StringVar(&cfg.mailer.transport, "mailer-transport", "smtp", "Mail transport (smtp|file|memory)")
+	flag.StringVar(&cfg.mailer.dir, "mailer-dir", "./tmp/mail", "Directory used by the file mail transport")
+	flag.StringVar(&cfg.mailer.sender, "mailer-sender", "GoBookAPI <no-reply@gobookapi.example>", "Mail sender")
+
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("SMTP_USERNAME"), "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password")
+
+	flag.Int64Var(&cfg.imports.maxBytes, "import-max-bytes", 32<<20, "Maximum size of book import request bodies")
+	flag.DurationVar(&cfg.exports.timeout, "export-timeout", time.Hour, "Maximum duration of a book export (0 disables the limit)")
+
+	flag.DurationVar(&cfg.trash.retention, "trash-retention", 30*24*time.Hour, "Time deleted books are kept in the trash before they are purged (0 disables purging)")
+	flag.DurationVar(&cfg.trash.purgeInterval, "trash-purge-interval", time.Hour, "Interval between purges of the trash")
+
+	cfg.permissions.defaults = []string{"books:read"}
+	flag.Func("default-permissions", "Permissions granted to new users (space separated, default \"books:read\")", func(val string) error {
+		cfg.permissions.defaults = strings.Fields(val)
+		return nil
+	})
+
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
@@ -82,6 +168,11 @@ func main() {
 
 	logger.PrintInfo("database connection pool established", nil)
 
+	transport, err := openMailTransport(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	expvar.NewString("version").Set(version)
 	expvar.Publish("goroutines", expvar.Func(func() interface{} {
 		return runtime.NumGoroutine()
@@ -99,6 +190,18 @@ func main() {
 		config: cfg,
 		logger: logger,
 		models: data.NewModels(db),
+		mailer: mailer.New(transport, cfg.mailer.sender),
+	}
+
+	switch cfg.tokens.mode {
+	case "stateful":
+	case "jwt":
+		app.jwtKeys, err = jwt.NewKeySet(cfg.jwt.keys...)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown token mode %q", cfg.tokens.mode), nil)
 	}
 
 	err = app.serve()
@@ -131,3 +234,18 @@ func openDB(cfg config) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// The openMailTransport() function returns the mail transport selected by the
+// -mailer-transport flag.
+func openMailTransport(cfg config) (mailer.Transport, error) {
+	switch cfg.mailer.transport {
+	case "smtp":
+		return mailer.NewSMTPTransport(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "file":
+		return mailer.NewFileTransport(cfg.mailer.dir)
+	case "memory":
+		return mailer.NewMemoryTransport(), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer transport %q", cfg.mailer.transport)
+	}
+}
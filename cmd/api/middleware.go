@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
 	"net"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,11 +20,44 @@ import (
 	"golang.org/x/time/rate"
 )
 
+// requestIDPattern matches the request IDs accepted from clients and proxies.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID middleware makes sure that every request has an ID, taken from the
+// X-Request-ID header when it is set to a sensible value and generated otherwise.
+// The ID is sent back in the response and stored in the request context, so that
+// log entries and audit events can be correlated.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			randomBytes := make([]byte, 16)
+
+			_, err := rand.Read(randomBytes)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(randomBytes)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		r = app.contextSetRequestID(r, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Recover from panics and handle errors gracefully.
 		defer func() {
 			if err := recover(); err != nil {
+				// Let the server abort responses which were deliberately cut off,
+				// such as failed exports.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
 				w.Header().Set("Connection", "close")
 				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
 			}
@@ -81,7 +117,8 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	})
 }
 
-// authenticate is middleware that checks and validates the authentication token in the request header.
+// authenticate is middleware that checks and validates the credentials in the request header.
+// It accepts either a bearer token ("Bearer <token>") or an API key ("ApiKey <key>").
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
@@ -94,30 +131,124 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		if len(headerParts) != 2 {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
-		token := headerParts[1]
-		v := validator.New()
 
-		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		switch {
+		case headerParts[0] == "Bearer" && app.jwtKeys != nil:
+			app.authenticateJWT(w, r, next, headerParts[1])
+		case headerParts[0] == "Bearer":
+			app.authenticateToken(w, r, next, headerParts[1])
+		case headerParts[0] == "ApiKey":
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+		default:
 			app.invalidAuthenticationTokenResponse(w, r)
-			return
 		}
+	})
+}
+
+// authenticateToken looks up the user for a bearer token and calls the next
+// handler with the user and the token stored in the request context.
+func (app *application) authenticateToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, &data.Token{
+		Plaintext: token,
+		Hash:      data.TokenHash(token),
+		UserID:    user.ID,
+		Scope:     data.ScopeAuthentication,
+	})
+	// Call the next handler in the chain.
+	next.ServeHTTP(w, r)
+}
 
-		user, err := app.models.Users.GetForToken(token)
+// authenticateJWT verifies a signed access token locally and calls the next
+// handler with the user built from its claims. The database is only consulted
+// when the revocation denylist is enabled.
+func (app *application) authenticateJWT(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	claims, err := app.jwtKeys.Verify(token, app.config.jwt.issuer, time.Now())
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	if app.config.jwt.denylist {
+		revoked, err := app.models.JWTDenylist.Contains(claims.ID)
 		if err != nil {
-			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
-			default:
-				app.serverErrorResponse(w, r, err)
-			}
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if revoked {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+	}
+
+	// The user is reconstructed from the claims, so it has no password hash or
+	// version. Handlers which modify the user must load it from the database.
+	user := &data.User{
+		ID:        claims.Subject,
+		Name:      claims.Name,
+		Email:     claims.Email,
+		Activated: claims.Activated,
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetClaims(r, claims)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateAPIKey looks up the user for an API key and calls the next handler
+// with the user and the key stored in the request context.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, keyPlaintext string) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	key, user, err := app.models.APIKeys.GetForPlaintext(keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	next.ServeHTTP(w, r)
+}
+
+// requireAuthenticatedUser is middleware that checks that the user is not anonymous.
+// If the user is anonymous, it sends an authentication required response.
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
 			return
 		}
-		r = app.contextSetUser(r, user)
-		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
 }
@@ -127,18 +258,72 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 // If the user is authenticated but not activated, it sends an inactive account response.
 // If the user is both authenticated and activated, it allows the request to proceed to the next handler.
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
-		if user.IsAnonymous() {
-			app.authenticationRequiredResponse(w, r)
-			return
-		}
 		if !user.Activated {
 			app.inactiveAccountResponse(w, r)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requirePermission is middleware that checks that the activated user holds the
+// given permission code, sending a not permitted response otherwise.
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		// Signed access tokens carry the permissions granted when they were
+		// issued; for every other credential they are looked up.
+		var permissions data.Permissions
+		if claims := app.contextGetClaims(r); claims != nil {
+			permissions = claims.Permissions
+		} else {
+			var err error
+			permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		// API keys may be restricted to a subset of their owner's permissions.
+		if key := app.contextGetAPIKey(r); key != nil && !key.Allows(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	// Wrap this with the requireActivatedUser() middleware, so anonymous and
+	// inactive users are rejected before the permissions are looked up.
+	return app.requireActivatedUser(fn)
+}
+
+// requireUserCredentials is middleware that rejects requests authenticated with
+// an API key, for endpoints that must only be reachable with the user's own
+// login, such as managing the API keys themselves.
+func (app *application) requireUserCredentials(next http.HandlerFunc) http.HandlerFunc {
+	return app.requireActivatedUser(app.rejectAPIKey(next))
+}
+
+// rejectAPIKey is the part of requireUserCredentials that doesn't need an
+// activated account, for the endpoints that let users fix their account before
+// it is activated again.
+func (app *application) rejectAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
 }
 
 // enableCORS middleware enables Cross-Origin Resource Sharing (CORS)
@@ -19,21 +19,86 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
 	//for books
-	router.HandlerFunc(http.MethodGet, "/v1/books", app.requireActivatedUser(app.listBooksHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/books", app.requireActivatedUser(app.createBookHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/books/:id", app.requireActivatedUser(app.showBookHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/books/:id", app.requireActivatedUser(app.updateBookHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/books/:id", app.requireActivatedUser(app.deleteBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books", app.requirePermission("books:read", app.listBooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books", app.requirePermission("books:write", app.createBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id", app.staticOrID(map[string]http.HandlerFunc{
+		"trash":   app.requirePermission("books:write", app.listTrashedBooksHandler),
+		"export":  app.requirePermission("books:read", app.exportBooksHandler),
+		"suggest": app.requirePermission("books:read", app.suggestBooksHandler),
+	}, app.requirePermission("books:read", app.showBookHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/books/:id", app.requirePermission("books:write", app.updateBookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/books/:id", app.requirePermission("books:write", app.deleteBookHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id", app.staticOrID(map[string]http.HandlerFunc{
+		"import": app.requirePermission("books:write", app.importBooksHandler),
+		"batch":  app.requirePermission("books:write", app.batchBooksHandler),
+	}, app.methodNotAllowedResponse))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/restore", app.requirePermission("books:write", app.restoreBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/versions", app.requirePermission("books:read", app.listBookVersionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/versions/:version", app.requirePermission("books:read", app.showBookVersionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/versions/:version/restore", app.requirePermission("books:write", app.restoreBookVersionHandler))
 
 	// for users
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireAuthenticatedUser(app.rejectAPIKey(app.updateCurrentUserHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedUser(app.rejectAPIKey(app.deleteCurrentUserHandler)))
+
+	// for two-factor authentication
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireUserCredentials(app.createTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp/confirm", app.requireUserCredentials(app.confirmTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp/recovery-codes", app.requireUserCredentials(app.createRecoveryCodesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireUserCredentials(app.deleteTOTPHandler))
+
+	// for API keys
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireUserCredentials(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireUserCredentials(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys/:id", app.requireUserCredentials(app.showAPIKeyHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/api-keys/:id", app.requireUserCredentials(app.updateAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireUserCredentials(app.deleteAPIKeyHandler))
 
 	// for authentication
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.rejectAPIKey(app.listAuthenticationTokensHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.rejectAPIKey(app.deleteAuthenticationTokenHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.rejectAPIKey(app.deleteAllAuthenticationTokensHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication/2fa", app.createTwoFactorAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.createRefreshTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+
+	// for administration
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("users:admin", app.updateUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id", app.requirePermission("users:admin", app.deleteUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/password-reset", app.requirePermission("users:admin", app.forcePasswordResetHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/sessions", app.requirePermission("users:admin", app.revokeUserSessionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/lockouts", app.requirePermission("users:admin", app.listLoginLockoutsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/lockouts", app.requirePermission("users:admin", app.deleteLoginLockoutHandler))
+
+	// for the audit trail
+	router.HandlerFunc(http.MethodGet, "/v1/audit", app.requirePermission("users:admin", app.listAuditEventsHandler))
 
 	// for our custom metrics,
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
 	// Wrap the router with the middlewares
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	return app.metrics(app.requestID(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))))
+}
+
+// staticOrID works around httprouter not allowing a static path segment and an
+// :id parameter at the same position, like /v1/books/trash and /v1/books/:id. It
+// is registered for the :id route and calls the handler named by the segment if
+// there is one, and the :id handler otherwise.
+func (app *application) staticOrID(static map[string]http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		if handler, ok := static[params.ByName("id")]; ok {
+			handler(w, r)
+			return
+		}
+		next(w, r)
+	}
 }
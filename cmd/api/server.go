@@ -19,10 +19,20 @@ func (app *application) serve() error {
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		// Store the connection of every request, so that a handler can extend its
+		// write deadline (see exportBooksHandler).
+		ConnContext: app.contextSetConn,
 	}
 
 	shutdownError := make(chan error)
 
+	// Start the periodic tasks, which run until the stop channel is closed on
+	// shutdown.
+	stop := make(chan struct{})
+	app.background(func() {
+		app.purgeTrash(stop)
+	})
+
 	// Set up a goroutine to handle server shutdown on signals.
 	go func() {
 		quit := make(chan os.Signal, 1)
@@ -34,7 +44,20 @@ func (app *application) serve() error {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		shutdownError <- srv.Shutdown(ctx)
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			shutdownError <- err
+			return
+		}
+
+		// Stop the periodic tasks and wait for any background goroutines, such as
+		// pending emails, to complete before reporting a clean shutdown.
+		app.logger.PrintInfo("completing background tasks", map[string]string{
+			"addr": srv.Addr,
+		})
+		close(stop)
+		app.wg.Wait()
+		shutdownError <- nil
 	}()
 
 	// Log server startup.
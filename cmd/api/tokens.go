@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/jwt"
 	"github.com/barantoraman/GoBookAPI/internal/validator"
 )
 
@@ -13,10 +18,13 @@ import (
 // based on the provided email and password. It validates the input,
 // checks the user's credentials, generates a token on success,
 // and responds with the token if authentication is successful.
+// Users with two-factor authentication enabled must also send an "otp" code, or
+// complete the login with the challenge token returned when it is missing.
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		OTP      string `json:"otp"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -32,11 +40,17 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Reject the attempt early if the account or the client IP address is locked
+	// after too many failures.
+	if !app.checkLoginLockout(w, r, input.Email) {
+		return
+	}
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			app.loginFailedResponse(w, r, input.Email, app.invalidCredentialsResponse)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -48,25 +62,540 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	// If the passwords don't match, then we call the app.invalidCredentialsResponse()
-	// helper again and return.
+	// If the passwords don't match, then we record the failure, call the
+	// app.invalidCredentialsResponse() helper again and return.
 	if !match {
-		app.invalidCredentialsResponse(w, r)
+		app.loginFailedResponse(w, r, input.Email, app.invalidCredentialsResponse)
+		return
+	}
+
+	// The password is correct, so check whether the user also needs to pass the
+	// second factor.
+	otp, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if otp != nil && otp.Confirmed {
+		if input.OTP == "" {
+			// Without a code we hand out a short-lived challenge token, which can
+			// be exchanged together with a code at /v1/tokens/authentication/2fa.
+			challenge, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTwoFactor)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			env := envelope{"two_factor_required": true, "challenge_token": challenge}
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		ok, err := app.verifySecondFactor(otp, input.OTP)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.loginFailedResponse(w, r, user.Email, app.invalidOTPResponse)
+			return
+		}
+	}
+
+	err = app.resetLoginFailures(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.startSession(w, r, user)
+}
+
+// createTwoFactorAuthenticationTokenHandler completes a login of a user with
+// two-factor authentication by exchanging a challenge token and a code for an
+// authentication token.
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChallengeToken string `json:"challenge_token"`
+		OTP            string `json:"otp"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.ChallengeToken)
+	v.Check(input.OTP != "", "otp", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTwoFactor, input.ChallengeToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkLoginLockout(w, r, user.Email) {
+		return
+	}
+
+	otp, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(otp, input.OTP)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.loginFailedResponse(w, r, user.Email, app.invalidOTPResponse)
+		return
+	}
+
+	err = app.models.Tokens.DeleteScopeForUser(data.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.resetLoginFailures(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.startSession(w, r, user)
+}
+
+// loginFailedResponse records a failed login attempt for the brute-force
+// protection and then sends the given error response.
+func (app *application) loginFailedResponse(w http.ResponseWriter, r *http.Request, email string, respond func(http.ResponseWriter, *http.Request)) {
+	err := app.recordLoginFailure(r, email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	respond(w, r)
+}
+
+// startSession starts a new token family for a user who has just logged in,
+// and responds with a short-lived access token along with a refresh token.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, user *data.User) {
+	family, err := data.GenerateFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := app.newTokenPair(user, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Encode the tokens to JSON and send them in the response along with a 201
+	// Created status code.
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createRefreshTokenHandler exchanges a refresh token for a new access token and
+// a new refresh token. Every refresh token can be exchanged once; replaying an
+// already used one revokes all tokens of its family.
+func (app *application) createRefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.UseRefreshToken(input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			// The token was stolen or the client is misbehaving. Either way,
+			// revoke the whole family so that both parties have to log in again.
+			app.logger.PrintInfo("refresh token reuse detected", map[string]string{
+				"user_id": strconv.FormatInt(token.UserID, 10),
+			})
+			err = app.models.Tokens.DeleteFamily(token.Family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.invalidRefreshTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := app.newTokenPair(user, token.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newTokenPair issues an access token and a refresh token in the given family,
+// using the lifetimes from the application config, and returns them ready to be
+// written as the response.
+func (app *application) newTokenPair(user *data.User, family []byte) (envelope, error) {
+	accessToken, err := app.newAccessToken(user, family)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := app.models.Tokens.NewForFamily(user.ID, app.config.tokens.refreshTTL, data.ScopeRefresh, family)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope{"authentication_token": accessToken, "refresh_token": refreshToken}, nil
+}
+
+// newAccessToken issues an access token for the user. In the default stateful
+// mode the token is stored in the database; in JWT mode it is a signed token
+// which carries the user details and permissions, and is not stored at all.
+func (app *application) newAccessToken(user *data.User, family []byte) (*data.Token, error) {
+	if app.jwtKeys == nil {
+		return app.models.Tokens.NewForFamily(user.ID, app.config.tokens.accessTTL, data.ScopeAuthentication, family)
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	jti := make([]byte, 16)
+	_, err = rand.Read(jti)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.tokens.accessTTL)
+
+	claims := jwt.Claims{
+		ID:          hex.EncodeToString(jti),
+		Issuer:      app.config.jwt.issuer,
+		Subject:     user.ID,
+		IssuedAt:    now.Unix(),
+		NotBefore:   now.Unix(),
+		Expiry:      expiry.Unix(),
+		Name:        user.Name,
+		Email:       user.Email,
+		Activated:   user.Activated,
+		Permissions: permissions,
+		Family:      hex.EncodeToString(family),
+	}
+
+	plaintext, err := app.jwtKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    time.Unix(claims.Expiry, 0),
+		Scope:     data.ScopeAuthentication,
+		CreatedAt: now,
+		Family:    family,
+	}
+	return token, nil
+}
+
+// createActivationTokenHandler emails a new activation token to the given
+// address, for example when the first one expired or after the email address
+// was changed. Like the password reset, the response doesn't reveal whether a
+// matching account exists.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		if user.Activated {
+			return
+		}
+
+		app.sendActivationToken(user)
+	})
+
+	env := envelope{"message": "if an inactive account with that email address exists, you will receive an email containing activation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPasswordResetTokenHandler emails a short-lived password reset token to
+// the given address. The response is the same whether or not an account exists
+// for the email, so it cannot be used to discover registered addresses.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Look up the user, issue the token and send the email in the background so
+	// that the response time does not depend on whether the account exists.
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		app.sendPasswordResetToken(user)
+	})
+
+	env := envelope{"message": "if an account with that email address exists, you will receive an email containing password reset instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// sendPasswordResetToken replaces the password reset tokens of the user with a
+// new one and emails it in the background. Only the most recently issued reset
+// token is usable.
+func (app *application) sendPasswordResetToken(user *data.User) {
+	app.background(func() {
+		err := app.models.Tokens.DeleteScopeForUser(data.ScopePasswordReset, user.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		data := map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
+
+// listAuthenticationTokensHandler lists the active sessions of the current user.
+// In JWT mode access tokens are not stored, so the sessions are represented by
+// their current refresh tokens instead.
+func (app *application) listAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	current := app.contextGetToken(r)
+	claims := app.contextGetClaims(r)
+
+	scope := data.ScopeAuthentication
+	if app.jwtKeys != nil {
+		scope = data.ScopeRefresh
+	}
+
+	tokens, err := app.models.Tokens.GetAllForUser(scope, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sessions := make([]data.Session, 0, len(tokens))
+	for _, token := range tokens {
+		isCurrent := current != nil && bytes.Equal(token.Hash, current.Hash)
+		if claims != nil {
+			isCurrent = claims.Family != "" && claims.Family == hex.EncodeToString(token.Family)
+		}
+
+		sessions = append(sessions, data.Session{
+			CreatedAt:  token.CreatedAt,
+			Expiry:     token.Expiry,
+			LastUsedAt: token.LastUsedAt,
+			Current:    isCurrent,
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAuthenticationTokenHandler revokes the bearer token used for the request,
+// along with the refresh token issued with it.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		err := app.revokeJWT(claims)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token := app.contextGetToken(r)
+	if token == nil {
+		app.invalidAuthenticationTokenResponse(w, r)
 		return
 	}
 
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour)
+	err := app.models.Tokens.DeleteByHash(token.Hash)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAllAuthenticationTokensHandler revokes every authentication token of the
+// current user, signing them out of all sessions.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.revokeSessions(app.models, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send it in the response along with a 201 Created
-	// status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	// Other signed access tokens can't be enumerated and stay valid until they
+	// expire, but the one used for this request is revoked right away.
+	if claims := app.contextGetClaims(r); claims != nil {
+		err = app.revokeJWT(claims)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all authentication tokens successfully revoked"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// revokeSessions deletes the stateful access tokens and the refresh tokens of a
+// user, with the given models so that it can be part of a transaction. The
+// refresh tokens have to go too, otherwise they could be used to start new
+// sessions.
+func (app *application) revokeSessions(models data.Models, userID int64) error {
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := models.Tokens.DeleteScopeForUser(scope, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeJWT puts a signed access token on the denylist, when it is enabled, and
+// deletes the refresh token of its family.
+func (app *application) revokeJWT(claims *jwt.Claims) error {
+	if app.config.jwt.denylist {
+		err := app.models.JWTDenylist.Add(claims.ID, time.Unix(claims.Expiry, 0))
+		if err != nil {
+			return err
+		}
+	}
+
+	family, err := hex.DecodeString(claims.Family)
+	if err != nil || len(family) == 0 {
+		return nil
+	}
+	return app.models.Tokens.DeleteFamily(family)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/totp"
+	"github.com/barantoraman/GoBookAPI/internal/validator"
+)
+
+// totpIssuer is the issuer name shown by authenticator apps.
+const totpIssuer = "GoBookAPI"
+
+// createTOTPHandler starts the two-factor authentication enrolment of the current
+// user. It responds with the new secret and the otpauth URI for authenticator
+// apps; the enrolment takes effect once it is confirmed with a valid code.
+func (app *application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Set(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.totpAlreadyEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"secret":      totp.EncodeSecret(secret),
+		"otpauth_uri": totp.URI(totpIssuer, user.Email, secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTOTPHandler enables two-factor authentication once the user proves that
+// their authenticator app produces valid codes, and responds with a set of
+// one-time recovery codes.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		OTP string `json:"otp"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.OTP != "", "otp", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	otp, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if otp.Confirmed {
+		app.totpAlreadyEnabledResponse(w, r)
+		return
+	}
+
+	// Recovery codes don't exist yet, so only a code from the app is accepted.
+	step, ok := totp.Validate(otp.Secret, strings.ReplaceAll(input.OTP, " ", ""), time.Now())
+	if ok {
+		ok, err = app.models.TOTP.UseStep(user.ID, step)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if !ok {
+		v.AddError("otp", "invalid or already used code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.TOTP.Confirm(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	codes, err := app.models.TOTP.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createRecoveryCodesHandler replaces the recovery codes of the current user
+// with a new set, after checking a valid code.
+func (app *application) createRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	ok := app.checkSecondFactor(w, r, user)
+	if !ok {
+		return
+	}
+
+	codes, err := app.models.TOTP.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteTOTPHandler disables two-factor authentication for the current user,
+// after checking a valid code.
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	ok := app.checkSecondFactor(w, r, user)
+	if !ok {
+		return
+	}
+
+	err := app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkSecondFactor reads an "otp" code from the request body and verifies it
+// against the confirmed enrolment of the user. It writes an error response and
+// returns false if the check fails.
+func (app *application) checkSecondFactor(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	var input struct {
+		OTP string `json:"otp"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return false
+	}
+
+	v := validator.New()
+
+	if v.Check(input.OTP != "", "otp", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	otp, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	if !otp.Confirmed {
+		app.notFoundResponse(w, r)
+		return false
+	}
+
+	ok, err := app.verifySecondFactor(otp, input.OTP)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !ok {
+		v.AddError("otp", "invalid or already used code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+	return true
+}
+
+// verifySecondFactor checks a code from the authenticator app or, failing that,
+// a recovery code. Either kind of code is only accepted once.
+func (app *application) verifySecondFactor(otp *data.TOTP, code string) (bool, error) {
+	code = strings.ReplaceAll(code, " ", "")
+
+	if step, ok := totp.Validate(otp.Secret, code, time.Now()); ok {
+		return app.models.TOTP.UseStep(otp.UserID, step)
+	}
+
+	return app.models.TOTP.UseRecoveryCode(otp.UserID, code)
+}
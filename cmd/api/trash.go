@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/barantoraman/GoBookAPI/internal/data"
+	"github.com/barantoraman/GoBookAPI/internal/validator"
+)
+
+// listTrashedBooksHandler lists the books in the trash, most recently deleted
+// first by default.
+func (app *application) listTrashedBooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Cursor = app.readInt(qs, "cursor", 1, v)
+	input.Filters.CursorSize = app.readInt(qs, "cursor_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-deleted_at")
+	input.Filters.SortSafeList = []string{"id", "title", "deleted_at", "-id", "-title", "-deleted_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	books, metadata, err := app.models.Books.GetAllTrashed(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"books": books, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// restoreBookHandler takes a book out of the trash.
+func (app *application) restoreBookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var book *data.Book
+
+	err = app.models.Transact(func(tx data.Models) error {
+		var err error
+
+		book, err = tx.Books.GetTrashed(id)
+		if err != nil {
+			return err
+		}
+		before := *book
+
+		err = tx.Books.Restore(book)
+		if err != nil {
+			return err
+		}
+		return app.recordBookChange(tx, r, "book.undeleted", &before, book)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateISBN):
+			app.duplicateISBNResponse(w, r, book.ISBN)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeTrash permanently removes the books which have been in the trash for
+// longer than the retention window, once per purge interval, until the stop
+// channel is closed.
+func (app *application) purgeTrash(stop <-chan struct{}) {
+	if app.config.trash.retention <= 0 || app.config.trash.purgeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(app.config.trash.purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		var ids []int64
+
+		err := app.models.Transact(func(tx data.Models) error {
+			var err error
+
+			ids, err = tx.Books.Purge(time.Now().Add(-app.config.trash.retention))
+			if err != nil {
+				return err
+			}
+
+			// Purges have no actor or request, so the events only name the book.
+			for _, id := range ids {
+				event := &data.AuditEvent{
+					Action:     "book.purged",
+					TargetType: data.AuditTargetBook,
+					TargetID:   id,
+				}
+
+				err = tx.Audit.Insert(event)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			continue
+		}
+
+		if len(ids) > 0 {
+			app.logger.PrintInfo("purged trash", map[string]string{
+				"books": strconv.Itoa(len(ids)),
+			})
+		}
+	}
+}
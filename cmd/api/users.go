@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/barantoraman/GoBookAPI/internal/data"
 	"github.com/barantoraman/GoBookAPI/internal/validator"
@@ -23,7 +25,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
-		Activated: true,
+		Activated: false,
 	}
 
 	// Set the password for the user using the provided input.
@@ -39,8 +41,26 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Insert the validated user into the database.
-	err = app.models.Users.Insert(user)
+	var token *data.Token
+
+	// Insert the validated user into the database, grant them the configured
+	// default permissions and generate an activation token which expires after 3
+	// days, all in one transaction, so that a failure doesn't leave behind an
+	// account which can't be activated or registered again.
+	err = app.models.Transact(func(tx data.Models) error {
+		err := tx.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Permissions.AddForUser(user.ID, app.config.permissions.defaults...)
+		if err != nil {
+			return err
+		}
+
+		token, err = tx.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		return err
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -52,9 +72,393 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Respond with the newly registered user data in JSON format.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	// Send the welcome email once the account has been committed, in the
+	// background so that the client doesn't have to wait for the SMTP round trip.
+	app.background(func() {
+		data := map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"userID":          user.ID,
+		}
+
+		err := app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	// Respond with the newly registered user data in JSON format. We use 202
+	// Accepted as the account still has to be activated.
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// activateUserHandler consumes an activation token and marks the associated user
+// account as activated.
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Retrieve the details of the user associated with the activation token. If no
+	// matching record is found, we let the client know that the token is invalid.
+	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Activated = true
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// If everything went successfully, delete all activation tokens for the user.
+	err = app.models.Tokens.DeleteScopeForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserPasswordHandler verifies a password reset token, sets the new
+// password and revokes every token belonging to the user.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Update() bumps the version number, so a concurrent change to the same user
+	// results in an edit conflict rather than a lost update.
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Revoke every token of the user, which also makes the reset token single-use
+	// and signs out any sessions started with the old password.
+	err = app.models.Tokens.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "your password was successfully reset"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCurrentUserHandler responds with the account of the authenticated user.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserHandler lets the authenticated user change their name, email
+// address or password. Changing the email address or the password requires the
+// current password; a new email address has to be activated again.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword *string `json:"current_password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Email addresses are case-insensitive, so a change of case alone doesn't need
+	// a new activation.
+	emailChanged := input.Email != nil && !strings.EqualFold(*input.Email, user.Email)
+	passwordChanged := input.Password != nil
+
+	if emailChanged || passwordChanged {
+		ok := app.checkCurrentPassword(w, r, user, input.CurrentPassword)
+		if !ok {
+			return
+		}
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Email != nil {
+		user.Email = *input.Email
+	}
+	if emailChanged {
+		user.Activated = false
+	}
+	if passwordChanged {
+		err = user.Password.Set(*input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A new password signs out every session, like a password reset does. Only
+	// the session tokens are removed, and before a new activation token is
+	// sent, so that the activation link keeps working.
+	if passwordChanged {
+		err = app.revokeSessions(app.models, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if claims := app.contextGetClaims(r); claims != nil {
+			err = app.revokeJWT(claims)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	if emailChanged {
+		app.sendActivationToken(user)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler deletes the account of the authenticated user after
+// checking their password. Their tokens are removed along with the account.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Password *string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	ok = app.checkCurrentPassword(w, r, user, input.Password)
+	if !ok {
+		return
+	}
+
+	// A signed access token stays valid until it expires, so put it on the
+	// denylist before the account goes away.
+	if claims := app.contextGetClaims(r); claims != nil {
+		err = app.revokeJWT(claims)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.Users.Delete(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your account was successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// loadCurrentUser reads the full record of the authenticated user from the
+// database. The user in the request context may have been built from JWT claims,
+// which carry neither the password hash nor the version.
+func (app *application) loadCurrentUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// checkCurrentPassword confirms a sensitive account change with the current
+// password of the user. Wrong passwords count towards the login lockout, so a
+// stolen session cannot be used to guess the password.
+func (app *application) checkCurrentPassword(w http.ResponseWriter, r *http.Request, user *data.User, password *string) bool {
+	v := validator.New()
+
+	if v.Check(password != nil && *password != "", "current_password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	if !app.checkLoginLockout(w, r, user.Email) {
+		return false
+	}
+
+	match, err := user.Password.Matches(*password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !match {
+		err = app.recordLoginFailure(r, user.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+	return true
+}
+
+// sendActivationToken replaces the activation tokens of the user with a new one
+// and emails it in the background.
+func (app *application) sendActivationToken(user *data.User) {
+	app.background(func() {
+		err := app.models.Tokens.DeleteScopeForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		data := map[string]interface{}{
+			"activationToken": token.Plaintext,
+		}
+
+		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
@@ -0,0 +1,317 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/barantoraman/GoBookAPI/internal/validator"
+	"github.com/lib/pq"
+)
+
+// apiKeyPrefix marks API keys so that they are easy to tell apart from bearer
+// tokens, and easy to spot when leaked.
+const apiKeyPrefix = "gba_"
+
+// APIKey is a long-lived credential that a user creates for machine clients.
+// Like tokens, only the SHA-256 hash of the key is stored.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry,omitempty"`
+	LastUsedAt  *time.Time  `json:"last_used_at,omitempty"`
+	Version     int32       `json:"version"`
+}
+
+// Allows reports whether the key may be used for the given permission code. An
+// empty Permissions slice means that the key carries all of its owner's
+// permissions; otherwise it is restricted to the listed subset.
+func (k *APIKey) Allows(code string) bool {
+	return len(k.Permissions) == 0 || k.Permissions.Include(code)
+}
+
+// ValidateAPIKeyPlaintext checks the format of an API key sent by a client.
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(keyPlaintext, apiKeyPrefix), "key", "must start with "+apiKeyPrefix)
+	v.Check(len(keyPlaintext) == len(apiKeyPrefix)+52, "key", "must be 56 bytes long")
+}
+
+// ValidateAPIKey checks the user supplied fields of an API key.
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	DB DBTX
+}
+
+// Insert generates a new key for the given record, stores its hash and fills in
+// the Plaintext field. The plaintext is never stored, so it can only be shown
+// to the user once.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	key.Plaintext = apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Hash = TokenHash(key.Plaintext)
+
+	if key.Permissions == nil {
+		key.Permissions = Permissions{}
+	}
+
+	query := `
+		INSERT INTO api_keys (user_id, name, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, version`
+
+	args := []interface{}{key.UserID, key.Name, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt, &key.Version)
+}
+
+// Get retrieves an API key by its ID, provided that it belongs to the user.
+func (m APIKeyModel) Get(id, userID int64) (*APIKey, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, user_id, name, hash, permissions, expiry, last_used_at, version
+		FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	var key APIKey
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		&key.Hash,
+		pq.Array((*[]string)(&key.Permissions)),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// GetAllForUser returns every API key of a user, including expired ones.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, user_id, name, hash, permissions, expiry, last_used_at, version
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Hash,
+			pq.Array((*[]string)(&key.Permissions)),
+			&key.Expiry,
+			&key.LastUsedAt,
+			&key.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Update changes the name, permissions and expiry of an API key, using the
+// version number to detect concurrent edits.
+func (m APIKeyModel) Update(key *APIKey) error {
+	query := `
+		UPDATE api_keys
+		SET name = $1, permissions = $2, expiry = $3, version = version + 1
+		WHERE id = $4 AND user_id = $5 AND version = $6
+		RETURNING version`
+
+	args := []interface{}{
+		key.Name,
+		pq.Array(key.Permissions),
+		key.Expiry,
+		key.ID,
+		key.UserID,
+		key.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&key.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes an API key, provided that it belongs to the user.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteAllForUser removes every API key of the user and returns the number of
+// keys removed.
+func (m APIKeyModel) DeleteAllForUser(userID int64) (int64, error) {
+	query := `
+		DELETE FROM api_keys
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// GetForPlaintext looks up an unexpired API key together with its owner, and
+// records the time the key was used. Like UserModel.GetForToken(), the time is
+// only written when the stored one is over a minute old, so that most requests
+// don't write to the api_keys table.
+func (m APIKeyModel) GetForPlaintext(keyPlaintext string) (*APIKey, *User, error) {
+	query := `
+		WITH key AS (
+			SELECT id, created_at, user_id, name, permissions, expiry, last_used_at, version,
+			last_used_at IS NULL OR last_used_at < $2::timestamptz - interval '1 minute' AS stale
+			FROM api_keys
+			WHERE hash = $1
+			AND (expiry IS NULL OR expiry > $2)
+		), touched AS (
+			UPDATE api_keys
+			SET last_used_at = $2
+			FROM key
+			WHERE api_keys.id = key.id
+			AND key.stale
+		)
+		SELECT key.id, key.created_at, key.user_id, key.name, key.permissions,
+		key.expiry, CASE WHEN key.stale THEN $2 ELSE key.last_used_at END, key.version,
+		users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		FROM key
+		INNER JOIN users
+		ON users.id = key.user_id`
+
+	var key APIKey
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, TokenHash(keyPlaintext), time.Now()).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		pq.Array((*[]string)(&key.Permissions)),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.Version,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	return &key, &user, nil
+}
@@ -0,0 +1,267 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Target types of audit events.
+const (
+	AuditTargetBook = "book"
+	AuditTargetUser = "user"
+)
+
+// AuditEvent records a single change made through the API: who made it, what
+// they did and to which record. Before and After hold the fields of the record
+// which the change touched, as they were before and after it.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ActorID    *int64          `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   int64           `json:"target_id"`
+	RequestID  string          `json:"request_id"`
+	IP         string          `json:"ip"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	Details    json.RawMessage `json:"details"`
+}
+
+// SetChanges stores the difference between two states of a record, given as
+// values which marshal to JSON objects. Only the fields whose values differ are
+// kept. A nil before or after, for a created or deleted record, keeps every field
+// of the other state.
+func (e *AuditEvent) SetChanges(before, after interface{}) error {
+	beforeFields, err := jsonFields(before)
+	if err != nil {
+		return err
+	}
+
+	afterFields, err := jsonFields(after)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range beforeFields {
+		if other, ok := afterFields[key]; ok && bytes.Equal(value, other) {
+			delete(beforeFields, key)
+			delete(afterFields, key)
+		}
+	}
+
+	if before != nil {
+		e.Before, err = json.Marshal(beforeFields)
+		if err != nil {
+			return err
+		}
+	}
+
+	if after != nil {
+		e.After, err = json.Marshal(afterFields)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// jsonFields marshals v and splits the resulting JSON object into its fields.
+func jsonFields(v interface{}) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if v == nil {
+		return fields, nil
+	}
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(js, &fields)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// AuditFilter holds the optional filters for listing audit events. Zero values
+// are not applied.
+type AuditFilter struct {
+	ActorID       int64
+	Action        string
+	TargetType    string
+	TargetID      int64
+	RequestID     string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+// Define the AuditModel type.
+type AuditModel struct {
+	DB DBTX
+}
+
+// Insert records a new audit event. The actor ID is nil for events without an
+// authenticated user, and details may be nil.
+func (m AuditModel) Insert(event *AuditEvent) error {
+	if event.Details == nil {
+		event.Details = json.RawMessage(`{}`)
+	}
+
+	query := `
+		INSERT INTO audit_events (actor_id, action, target_type, target_id, request_id, ip, before, after, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		event.ActorID,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.RequestID,
+		event.IP,
+		nullJSON(event.Before),
+		nullJSON(event.After),
+		[]byte(event.Details),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// InsertMany records many audit events at once with COPY, so this must run in a
+// transaction (see Models.Transact). Unlike Insert(), it doesn't set the IDs and
+// creation times of the events.
+func (m AuditModel) InsertMany(events []*AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt, err := m.DB.PrepareContext(ctx, pq.CopyIn("audit_events", "actor_id", "action", "target_type", "target_id", "request_id", "ip", "before", "after", "details"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, event := range events {
+		if event.Details == nil {
+			event.Details = json.RawMessage(`{}`)
+		}
+
+		// COPY would encode []byte values as bytea, so the JSON is sent as text.
+		_, err = stmt.ExecContext(ctx,
+			event.ActorID,
+			event.Action,
+			event.TargetType,
+			event.TargetID,
+			event.RequestID,
+			event.IP,
+			nullJSONText(event.Before),
+			nullJSONText(event.After),
+			string(event.Details),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+// GetAll returns the audit events matching the given filters.
+func (m AuditModel) GetAll(filter AuditFilter, filters Filters) ([]*AuditEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, actor_id, action, target_type, target_id, request_id, ip, before, after, details
+		FROM audit_events
+		WHERE (actor_id = $1 OR $1 = 0)
+		AND (action = $2 OR $2 = '')
+		AND (target_type = $3 OR $3 = '')
+		AND (target_id = $4 OR $4 = 0)
+		AND (request_id = $5 OR $5 = '')
+		AND (created_at >= $6 OR $6 IS NULL)
+		AND (created_at < $7 OR $7 IS NULL)
+		ORDER BY %s %s, id DESC
+		LIMIT $8 OFFSET $9`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{
+		filter.ActorID,
+		filter.Action,
+		filter.TargetType,
+		filter.TargetID,
+		filter.RequestID,
+		filter.CreatedAfter,
+		filter.CreatedBefore,
+		filters.limit(),
+		filters.offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var event AuditEvent
+		var before, after []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.Action,
+			&event.TargetType,
+			&event.TargetID,
+			&event.RequestID,
+			&event.IP,
+			&before,
+			&after,
+			&event.Details,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		event.Before = before
+		event.After = after
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Cursor, filters.CursorSize)
+	return events, metadata, nil
+}
+
+// nullJSON converts an empty JSON value to an SQL NULL.
+func nullJSON(js json.RawMessage) interface{} {
+	if js == nil {
+		return nil
+	}
+	return []byte(js)
+}
+
+// nullJSONText is like nullJSON(), but returns the JSON as a string.
+func nullJSONText(js json.RawMessage) interface{} {
+	if js == nil {
+		return nil
+	}
+	return string(js)
+}
@@ -3,45 +3,187 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/barantoraman/GoBookAPI/internal/isbn"
 	"github.com/barantoraman/GoBookAPI/internal/validator"
 	"github.com/lib/pq"
 )
 
 type Book struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	ISBN      string    `json:"isbn"`
-	Title     string    `json:"title"`
-	Author    string    `json:"author"`
-	Genres    []string  `json:"genres"`
-	Pages     Pages     `json:"pages"`
-	Language  string    `json:"language"`
-	Publisher string    `json:"publisher"`
-	Year      int32     `json:"year"`
-	Version   int32     `json:"version"`
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"-"`
+	ISBN      string     `json:"isbn"`
+	Title     string     `json:"title"`
+	Author    string     `json:"author"`
+	Genres    []string   `json:"genres"`
+	Pages     Pages      `json:"pages"`
+	Language  string     `json:"language"`
+	Publisher string     `json:"publisher"`
+	Year      int32      `json:"year"`
+	Version   int32      `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Match     *BookMatch `json:"match,omitempty"`
+}
+
+// BookMatch describes how a book matched a full-text search: its relevance and
+// the fields in which the search terms were found, with the terms highlighted
+// in <b> tags. The genres are highlighted as a single comma-separated string.
+type BookMatch struct {
+	Relevance  float32           `json:"relevance"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// ErrDuplicateISBN is returned when a book would share its ISBN with another book
+// which is not in the trash.
+var ErrDuplicateISBN = errors.New("duplicate isbn")
+
+// bookJSON has the fields of Book without its MarshalJSON() method, so that the
+// custom marshalers below can embed it.
+type bookJSON Book
+
+// MarshalJSON adds the ISBN-10 form of the ISBN, when there is one, to the JSON
+// representation of the book.
+func (b Book) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		bookJSON
+		ISBN10 string `json:"isbn_10,omitempty"`
+	}{
+		bookJSON: bookJSON(b),
+		ISBN10:   isbn.To10(b.ISBN),
+	})
 }
 
 type BookModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
-// inserts a new book record into the database.
+// inserts a new book record into the database, along with its first revision.
 func (b BookModel) Insert(book *Book) error {
 	query := `
-		INSERT INTO books (isbn, title, author, genres, pages, language , publisher, year)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		RETURNING id, created_at, version`
+		WITH book AS (
+			INSERT INTO books (isbn, title, author, genres, pages, language , publisher, year)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING *
+		), revision AS (
+			INSERT INTO book_versions (book_id, version, isbn, title, author, genres, pages, language, publisher, year)
+			SELECT id, version, isbn, title, author, genres, pages, language, publisher, year FROM book
+		)
+		SELECT id, created_at, version FROM book`
 
 	args := []interface{}{book.ISBN, book.Title, book.Author, pq.Array(book.Genres), book.Pages, book.Language, book.Publisher, book.Year}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return b.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.Version)
+	err := b.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "books_isbn_unique_idx"):
+			return ErrDuplicateISBN
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// inserts many books at once, along with their first revisions. The books are
+// loaded into a temporary staging table with COPY and inserted from there, so
+// this must run in a transaction (see Models.Transact). Books whose ISBN is
+// already taken, by an existing book or by an earlier book of the slice, are
+// skipped and keep a zero ID.
+func (b BookModel) InsertMany(books []*Book) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := b.DB.ExecContext(ctx, `
+		CREATE TEMPORARY TABLE book_import (
+			position integer NOT NULL,
+			isbn text NOT NULL,
+			title text NOT NULL,
+			author text NOT NULL,
+			genres text[] NOT NULL,
+			pages integer NOT NULL,
+			language text NOT NULL,
+			publisher text NOT NULL,
+			year integer NOT NULL
+		) ON COMMIT DROP`)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := b.DB.PrepareContext(ctx, pq.CopyIn("book_import", "position", "isbn", "title", "author", "genres", "pages", "language", "publisher", "year"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, book := range books {
+		_, err = stmt.ExecContext(ctx, i, book.ISBN, book.Title, book.Author, pq.Array(book.Genres), book.Pages, book.Language, book.Publisher, book.Year)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Flush the buffered rows.
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only the first book of the batch with a given ISBN is inserted, in the order
+	// of the batch, and books with a taken ISBN are skipped by ON CONFLICT.
+	query := `
+		WITH book AS (
+			INSERT INTO books (isbn, title, author, genres, pages, language, publisher, year)
+			SELECT isbn, title, author, genres, pages, language, publisher, year
+			FROM (
+				SELECT DISTINCT ON (isbn) *
+				FROM book_import
+				ORDER BY isbn, position
+			) AS first_import
+			ORDER BY position
+			ON CONFLICT (isbn) WHERE deleted_at IS NULL DO NOTHING
+			RETURNING *
+		), revision AS (
+			INSERT INTO book_versions (book_id, version, isbn, title, author, genres, pages, language, publisher, year)
+			SELECT id, version, isbn, title, author, genres, pages, language, publisher, year FROM book
+		)
+		SELECT first_import.position, book.id, book.created_at, book.version
+		FROM book
+		INNER JOIN (
+			SELECT DISTINCT ON (isbn) isbn, position
+			FROM book_import
+			ORDER BY isbn, position
+		) AS first_import ON first_import.isbn = book.isbn`
+
+	rows, err := b.DB.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var position int
+
+		var book Book
+		err := rows.Scan(&position, &book.ID, &book.CreatedAt, &book.Version)
+		if err != nil {
+			return err
+		}
+
+		books[position].ID = book.ID
+		books[position].CreatedAt = book.CreatedAt
+		books[position].Version = book.Version
+	}
+
+	return rows.Err()
 }
 
 // retrieves a book record from the database by its ID.
@@ -52,7 +194,7 @@ func (b BookModel) Get(id int64) (*Book, error) {
 	query := `
 	SELECT id, created_at, isbn, title, author, genres, pages, language, publisher, year, version
 	FROM books
-	WHERE id = $1`
+	WHERE id = $1 AND deleted_at IS NULL`
 
 	var book Book
 
@@ -84,13 +226,43 @@ func (b BookModel) Get(id int64) (*Book, error) {
 	return &book, nil
 }
 
-// updates a book record in the database.
+// retrieves the ID of the book with the given ISBN, ignoring books in the trash.
+func (b BookModel) GetIDByISBN(isbn string) (int64, error) {
+	query := `
+		SELECT id
+		FROM books
+		WHERE isbn = $1 AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := b.DB.QueryRowContext(ctx, query, isbn).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// updates a book record in the database and stores the result as a new revision.
 func (b BookModel) Update(book *Book) error {
 	query := `
-		UPDATE books
-		SET isbn = $1, title = $2, author = $3, genres = $4, pages = $5, language = $6, publisher = $7 , year = $8, version = version + 1 
-		WHERE id = $9 AND version = $10
-		RETURNING version`
+		WITH book AS (
+			UPDATE books
+			SET isbn = $1, title = $2, author = $3, genres = $4, pages = $5, language = $6, publisher = $7 , year = $8, version = version + 1 
+			WHERE id = $9 AND version = $10 AND deleted_at IS NULL
+			RETURNING *
+		), revision AS (
+			INSERT INTO book_versions (book_id, version, isbn, title, author, genres, pages, language, publisher, year)
+			SELECT id, version, isbn, title, author, genres, pages, language, publisher, year FROM book
+		)
+		SELECT version FROM book`
 
 	args := []interface{}{
 		book.ISBN,
@@ -110,6 +282,8 @@ func (b BookModel) Update(book *Book) error {
 	err := b.DB.QueryRowContext(ctx, query, args...).Scan(&book.Version)
 	if err != nil {
 		switch {
+		case isUniqueViolation(err, "books_isbn_unique_idx"):
+			return ErrDuplicateISBN
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
@@ -119,21 +293,92 @@ func (b BookModel) Update(book *Book) error {
 	return nil
 }
 
-// removes a book record from the database by its ID.
-func (b BookModel) Delete(id int64) error {
-	if id < 1 {
+// moves a book to the trash. The book is hidden from Get() and GetAll() until it
+// is restored or purged. Like Update(), it only succeeds if the book still has
+// the version it was read with.
+func (b BookModel) Delete(book *Book) error {
+	if book.ID < 1 {
 		return ErrRecordNotFound
 	}
 	query := `
-		DELETE FROM books
-		WHERE id = $1`
+		UPDATE books
+		SET deleted_at = $2
+		WHERE id = $1 AND version = $3 AND deleted_at IS NULL
+		RETURNING deleted_at`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := b.DB.ExecContext(ctx, query, id)
+	err := b.DB.QueryRowContext(ctx, query, book.ID, time.Now(), book.Version).Scan(&book.DeletedAt)
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// retrieves a book in the trash by its ID.
+func (b BookModel) GetTrashed(id int64) (*Book, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, isbn, title, author, genres, pages, language, publisher, year, version, deleted_at
+		FROM books
+		WHERE id = $1 AND deleted_at IS NOT NULL`
+
+	var book Book
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := b.DB.QueryRowContext(ctx, query, id).Scan(
+		&book.ID,
+		&book.CreatedAt,
+		&book.ISBN,
+		&book.Title,
+		&book.Author,
+		pq.Array(&book.Genres),
+		&book.Pages,
+		&book.Language,
+		&book.Publisher,
+		&book.Year,
+		&book.Version,
+		&book.DeletedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &book, nil
+}
+
+// takes a book out of the trash.
+func (b BookModel) Restore(book *Book) error {
+	query := `
+		UPDATE books
+		SET deleted_at = NULL
+		WHERE id = $1 AND deleted_at IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := b.DB.ExecContext(ctx, query, book.ID)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "books_isbn_unique_idx"):
+			return ErrDuplicateISBN
+		default:
+			return err
+		}
 	}
 
 	rowsAffected, err := result.RowsAffected()
@@ -144,40 +389,32 @@ func (b BookModel) Delete(id int64) error {
 	if rowsAffected == 0 {
 		return ErrRecordNotFound
 	}
+
+	book.DeletedAt = nil
 	return nil
 }
 
-// retrieves a list of book records from the database based on the provided filters.
-func (b BookModel) GetAll(isbn string, title string, author string, genres []string, filters Filters) ([]*Book, Metadata, error) {
+// retrieves the books in the trash, paginated with the provided filters.
+func (b BookModel) GetAllTrashed(filters Filters) ([]*Book, Metadata, error) {
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, isbn, title, author, genres, pages, language, publisher, year, version
+		SELECT count(*) OVER(), id, created_at, isbn, title, author, genres, pages, language, publisher, year, version, deleted_at
 		FROM books
-		WHERE (isbn = $1 OR $1 = '')
-		AND (to_tsvector('simple',title) @@ plainto_tsquery('simple', $2) OR $2 = '')
-		AND (to_tsvector('simple',author) @@ plainto_tsquery('simple', $3) OR $3 = '')
-		AND (genres @> $4 OR $4 = '{}')
-		ORDER BY %s %s , id ASC
-		LIMIT $5 OFFSET $6`, filters.sortColumn(), filters.sortDirection())
+		WHERE deleted_at IS NOT NULL
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortDirection())
 
-	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{isbn, title, author, pq.Array(genres), filters.limit(), filters.offset()}
-
-	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
-	// containing the result.
-	rows, err := b.DB.QueryContext(ctx, query, args...)
+	rows, err := b.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
 	if err != nil {
-		return nil, Metadata{}, err //update this to return an empty metadata struct
+		return nil, Metadata{}, err
 	}
 	defer rows.Close()
 
 	totalRecords := 0
-	//Initialize an empty slice to hold the book data
 	books := []*Book{}
 
-	//Use rows.Next to iterate through the rows in the resultset.
 	for rows.Next() {
 		var book Book
 		err := rows.Scan(
@@ -193,6 +430,7 @@ func (b BookModel) GetAll(isbn string, title string, author string, genres []str
 			&book.Publisher,
 			&book.Year,
 			&book.Version,
+			&book.DeletedAt,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -207,11 +445,784 @@ func (b BookModel) GetAll(isbn string, title string, author string, genres []str
 	return books, metadata, nil
 }
 
+// permanently removes the books which were moved to the trash before the given
+// time, along with their revisions, and returns their IDs.
+func (b BookModel) Purge(deletedBefore time.Time) ([]int64, error) {
+	query := `
+		DELETE FROM books
+		WHERE deleted_at < $1
+		RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := b.DB.QueryContext(ctx, query, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// BookVersion is a past or current revision of a book. The embedded Book holds
+// the fields as they were in that revision, with ID being the ID of the book.
+type BookVersion struct {
+	Book
+	RevisedAt time.Time `json:"revised_at"`
+}
+
+// MarshalJSON is needed as BookVersion would otherwise be marshaled with the
+// promoted MarshalJSON() method of Book, which drops RevisedAt.
+func (v BookVersion) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		bookJSON
+		ISBN10    string    `json:"isbn_10,omitempty"`
+		RevisedAt time.Time `json:"revised_at"`
+	}{
+		bookJSON:  bookJSON(v.Book),
+		ISBN10:    isbn.To10(v.ISBN),
+		RevisedAt: v.RevisedAt,
+	})
+}
+
+// retrieves a single revision of a book.
+func (b BookModel) GetVersion(id int64, version int32) (*BookVersion, error) {
+	if id < 1 || version < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT book_id, created_at, isbn, title, author, genres, pages, language, publisher, year, version
+		FROM book_versions
+		WHERE book_id = $1 AND version = $2`
+
+	var revision BookVersion
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := b.DB.QueryRowContext(ctx, query, id, version).Scan(
+		&revision.ID,
+		&revision.RevisedAt,
+		&revision.ISBN,
+		&revision.Title,
+		&revision.Author,
+		pq.Array(&revision.Genres),
+		&revision.Pages,
+		&revision.Language,
+		&revision.Publisher,
+		&revision.Year,
+		&revision.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &revision, nil
+}
+
+// retrieves the revisions of a book, paginated with the provided filters.
+func (b BookModel) GetAllVersions(id int64, filters Filters) ([]*BookVersion, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), book_id, created_at, isbn, title, author, genres, pages, language, publisher, year, version
+		FROM book_versions
+		WHERE book_id = $1
+		ORDER BY %s %s
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := b.DB.QueryContext(ctx, query, id, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	revisions := []*BookVersion{}
+
+	for rows.Next() {
+		var revision BookVersion
+		err := rows.Scan(
+			&totalRecords,
+			&revision.ID,
+			&revision.RevisedAt,
+			&revision.ISBN,
+			&revision.Title,
+			&revision.Author,
+			pq.Array(&revision.Genres),
+			&revision.Pages,
+			&revision.Language,
+			&revision.Publisher,
+			&revision.Year,
+			&revision.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		revisions = append(revisions, &revision)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Cursor, filters.CursorSize)
+	return revisions, metadata, nil
+}
+
+// BookFilter holds the optional filters for listing books. Zero values are not
+// applied.
+type BookFilter struct {
+	ISBN   string
+	Title  string
+	Author string
+
+	// Genres matches books with all of the genres, or any of them with
+	// GenresAny. Languages and Publishers match books with any of the values.
+	Genres     []string
+	GenresAny  bool
+	Languages  []string
+	Publishers []string
+
+	// The ranges include their bounds. Nil bounds are not applied.
+	YearMin       *int
+	YearMax       *int
+	PagesMin      *int
+	PagesMax      *int
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+
+	// Query is a full-text search across the title, author, publisher and
+	// genres, in the syntax of web search engines. The terms are matched exactly
+	// and, if QueryLanguage is set, also stemmed for that language. A Fuzzy
+	// search rather matches titles and authors containing words similar to the
+	// query, so that misspelled names are still found.
+	Query         string
+	QueryLanguage string
+	Fuzzy         bool
+}
+
+// searchQuery returns the tsquery of the full-text search of the filter, adding
+// its arguments to args.
+func (f BookFilter) searchQuery(args *queryArgs) string {
+	query := args.add(f.Query)
+
+	tsquery := "websearch_to_tsquery('simple', " + query + ")"
+	if f.QueryLanguage != "" {
+		tsquery = "(" + tsquery + " || websearch_to_tsquery(books_search_config(" + args.add(f.QueryLanguage) + "), " + query + "))"
+	}
+	return tsquery
+}
+
+// relevance returns the SQL expression for the relevance of a book to the search
+// of the filter, adding its arguments to args. For fuzzy searches, it is the
+// similarity of the query to the closest words of the title or the author.
+func (f BookFilter) relevance(args *queryArgs) string {
+	if f.Fuzzy {
+		query := args.add(f.Query)
+		return "greatest(word_similarity(" + query + ", title), word_similarity(" + query + ", author))"
+	}
+	return "ts_rank(search, " + f.searchQuery(args) + ")"
+}
+
+// sortExpression returns the SQL expression for a sort column of books, adding
+// its arguments to args. Sorting by relevance needs a search.
+func (f BookFilter) sortExpression(column string, args *queryArgs) string {
+	if column == "relevance" {
+		return f.relevance(args)
+	}
+	return column
+}
+
+// where returns the WHERE clause which selects the books matching the filter and
+// not in the trash, adding its arguments to args.
+func (f BookFilter) where(args *queryArgs) string {
+	conditions := []string{"deleted_at IS NULL"}
+
+	if f.ISBN != "" {
+		conditions = append(conditions, "isbn = "+args.add(f.ISBN))
+	}
+	if f.Title != "" {
+		conditions = append(conditions, "to_tsvector('simple', title) @@ plainto_tsquery('simple', "+args.add(f.Title)+")")
+	}
+	if f.Author != "" {
+		conditions = append(conditions, "to_tsvector('simple', author) @@ plainto_tsquery('simple', "+args.add(f.Author)+")")
+	}
+	if len(f.Genres) > 0 {
+		operator := "@>"
+		if f.GenresAny {
+			operator = "&&"
+		}
+		conditions = append(conditions, "genres "+operator+" "+args.add(pq.Array(f.Genres)))
+	}
+	if len(f.Languages) > 0 {
+		conditions = append(conditions, "language = ANY("+args.add(pq.Array(f.Languages))+")")
+	}
+	if len(f.Publishers) > 0 {
+		conditions = append(conditions, "publisher = ANY("+args.add(pq.Array(f.Publishers))+")")
+	}
+	if f.YearMin != nil {
+		conditions = append(conditions, "year >= "+args.add(*f.YearMin))
+	}
+	if f.YearMax != nil {
+		conditions = append(conditions, "year <= "+args.add(*f.YearMax))
+	}
+	if f.PagesMin != nil {
+		conditions = append(conditions, "pages >= "+args.add(*f.PagesMin))
+	}
+	if f.PagesMax != nil {
+		conditions = append(conditions, "pages <= "+args.add(*f.PagesMax))
+	}
+	if f.CreatedAfter != nil {
+		conditions = append(conditions, "created_at >= "+args.add(*f.CreatedAfter))
+	}
+	if f.CreatedBefore != nil {
+		conditions = append(conditions, "created_at < "+args.add(*f.CreatedBefore))
+	}
+	if f.Query != "" && f.Fuzzy {
+		query := args.add(f.Query)
+		conditions = append(conditions, "("+query+" <% title OR "+query+" <% author)")
+	}
+	if f.Query != "" && !f.Fuzzy {
+		conditions = append(conditions, "search @@ "+f.searchQuery(args))
+	}
+
+	return "WHERE " + strings.Join(conditions, " AND ")
+}
+
+// bookSortKey returns the value of the sort column of a book, as stored in
+// cursors.
+func bookSortKey(book *Book, column string) string {
+	switch column {
+	case "title":
+		return book.Title
+	case "author":
+		return book.Author
+	case "year":
+		return strconv.FormatInt(int64(book.Year), 10)
+	case "relevance":
+		return strconv.FormatFloat(float64(book.Match.Relevance), 'g', -1, 32)
+	default:
+		return strconv.FormatInt(book.ID, 10)
+	}
+}
+
+// headlineOptions are the options of the ts_headline() snippets of searches. The
+// fields are short, so they are highlighted as a whole.
+const headlineOptions = "HighlightAll=true"
+
+// BookFields are the fields of the JSON representation of books which can be
+// selected with sparse fieldsets. The match is only set for searches.
+var BookFields = []string{"id", "isbn", "isbn_10", "title", "author", "genres", "pages", "language", "publisher", "year", "version", "match"}
+
+// bookColumn is a column of the books table and the field of a Book to scan it
+// into.
+type bookColumn struct {
+	name string
+	dest func(book *Book) interface{}
+}
+
+// bookColumns are the columns read by GetAll(), in the order in which they are
+// selected.
+var bookColumns = []bookColumn{
+	{"id", func(book *Book) interface{} { return &book.ID }},
+	{"created_at", func(book *Book) interface{} { return &book.CreatedAt }},
+	{"isbn", func(book *Book) interface{} { return &book.ISBN }},
+	{"title", func(book *Book) interface{} { return &book.Title }},
+	{"author", func(book *Book) interface{} { return &book.Author }},
+	{"genres", func(book *Book) interface{} { return pq.Array(&book.Genres) }},
+	{"pages", func(book *Book) interface{} { return &book.Pages }},
+	{"language", func(book *Book) interface{} { return &book.Language }},
+	{"publisher", func(book *Book) interface{} { return &book.Publisher }},
+	{"year", func(book *Book) interface{} { return &book.Year }},
+	{"version", func(book *Book) interface{} { return &book.Version }},
+}
+
+// selectBookColumns returns the columns needed for the given fields, or every
+// column if no fields are given. The ID and the extra columns are always read.
+func selectBookColumns(fields []string, extra ...string) []bookColumn {
+	if len(fields) == 0 {
+		return bookColumns
+	}
+
+	needed := map[string]bool{"id": true}
+	for _, name := range append(fields, extra...) {
+		if name == "isbn_10" {
+			name = "isbn"
+		}
+		needed[name] = true
+	}
+
+	var columns []bookColumn
+	for _, column := range bookColumns {
+		if needed[column.name] {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// retrieves a page of the books matching the filter, starting at the cursor of
+// filters. Only the columns needed for the given fields are read, or all of them
+// if there are none; the other fields of the books are left empty. The metadata
+// holds the cursors of the next and previous pages, when there are any, and the
+// total number of matching books if filters asks for it. With a full-text
+// search, every book also comes with its match.
+func (b BookModel) GetAll(filter BookFilter, filters KeysetFilters, fields []string) ([]*Book, Metadata, error) {
+	column := filters.sortColumn()
+	direction := filters.sortDirection()
+
+	// The highlights of full-text searches are computed from the page, so it
+	// needs the highlighted fields and the language whatever the fields asked for.
+	extra := []string{column}
+	if filter.Query != "" && !filter.Fuzzy {
+		extra = append(extra, "title", "author", "publisher", "genres", "language")
+	}
+
+	columns := selectBookColumns(fields, extra...)
+
+	var names []string
+	for _, c := range columns {
+		names = append(names, c.name)
+	}
+	selected := strings.Join(names, ", ")
+
+	var args queryArgs
+	where := filter.where(&args)
+
+	// Create a context with a 3-second timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	metadata := Metadata{CursorSize: filters.CursorSize}
+
+	if filters.Total {
+		query := "SELECT count(*) FROM books " + where
+
+		err := b.DB.QueryRowContext(ctx, query, args...).Scan(&metadata.TotalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	sortExpression := filter.sortExpression(column, &args)
+
+	if filters.Cursor != nil {
+		// The keys of numeric columns would otherwise fail in the query.
+		var err error
+		switch column {
+		case "id":
+			_, err = strconv.ParseInt(filters.Cursor.Key, 10, 64)
+		case "year":
+			_, err = strconv.ParseInt(filters.Cursor.Key, 10, 32)
+		case "relevance":
+			_, err = strconv.ParseFloat(filters.Cursor.Key, 32)
+		}
+		if err != nil {
+			return nil, Metadata{}, ErrInvalidCursor
+		}
+
+		where += " AND " + filters.seek(sortExpression, args.add(filters.Cursor.Key), args.add(filters.Cursor.ID))
+	}
+
+	// The relevance and the highlights of searches are only computed for the books
+	// of the page. Fuzzy searches have no highlights.
+	relevance, highlights := "NULL::real", "NULL, NULL, NULL, NULL"
+	if filter.Query != "" {
+		relevance = filter.relevance(&args)
+	}
+	if filter.Query != "" && !filter.Fuzzy {
+		tsquery := filter.searchQuery(&args)
+
+		var headlines []string
+		for _, field := range []string{"title", "author", "publisher", "array_to_string(genres, ', ')"} {
+			headlines = append(headlines, fmt.Sprintf("ts_headline(books_search_config(language), %s, %s, '%s')", field, tsquery, headlineOptions))
+		}
+		highlights = strings.Join(headlines, ", ")
+	}
+
+	// Read one more book than asked for, to find out whether there is a page after
+	// this one.
+	query := fmt.Sprintf(`
+		SELECT %s, relevance, %s
+		FROM (
+			SELECT %s, %s AS relevance
+			FROM books
+			%s
+			ORDER BY %s %s, id %s
+			LIMIT %s
+		) AS page
+		ORDER BY %s %s, id %s`,
+		selected, highlights,
+		selected, relevance,
+		where,
+		sortExpression, direction, direction,
+		args.add(filters.CursorSize+1),
+		column, direction, direction)
+
+	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
+	// containing the result.
+	rows, err := b.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err //update this to return an empty metadata struct
+	}
+	defer rows.Close()
+
+	//Initialize an empty slice to hold the book data
+	books := []*Book{}
+
+	//Use rows.Next to iterate through the rows in the resultset.
+	for rows.Next() {
+		var book Book
+		var rank sql.NullFloat64
+		var title, author, publisher, genres sql.NullString
+
+		var dest []interface{}
+		for _, c := range columns {
+			dest = append(dest, c.dest(&book))
+		}
+		dest = append(dest, &rank, &title, &author, &publisher, &genres)
+
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		if rank.Valid {
+			book.Match = &BookMatch{Relevance: float32(rank.Float64)}
+		}
+		if title.Valid {
+			// ts_headline() returns every field, so only keep those in which a
+			// search term was highlighted.
+			book.Match.Highlights = map[string]string{}
+			for field, headline := range map[string]string{
+				"title":     title.String,
+				"author":    author.String,
+				"publisher": publisher.String,
+				"genres":    genres.String,
+			} {
+				if strings.Contains(headline, "<b>") {
+					book.Match.Highlights[field] = headline
+				}
+			}
+		}
+
+		books = append(books, &book)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	more := len(books) > filters.CursorSize
+	if more {
+		books = books[:filters.CursorSize]
+	}
+
+	backward := filters.Cursor != nil && filters.Cursor.Backward
+	if backward {
+		// The books were read in reverse, so put them back in order.
+		for i, j := 0, len(books)-1; i < j; i, j = i+1, j-1 {
+			books[i], books[j] = books[j], books[i]
+		}
+	}
+
+	if len(books) > 0 {
+		first, last := books[0], books[len(books)-1]
+
+		metadata.NextCursor, metadata.PrevCursor = filters.pageCursors(bookSortKey(first, column), first.ID, bookSortKey(last, column), last.ID, more)
+	}
+
+	return books, metadata, nil
+}
+
+// BookFacets are the facets which can be counted for book listings. Years are
+// counted by decade.
+var BookFacets = []string{"genres", "language", "publisher", "year"}
+
+// maxFacetValues is the number of most common values returned per facet. Every
+// decade is returned for the year facet.
+const maxFacetValues = 20
+
+// FacetCount is the number of books with a value of a facet.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// bookFacetQueries are the queries counting the values of each facet over the
+// matching books. Every value is ranked within its facet, in the order in which
+// the values are returned. The queries are joined with UNION ALL, so each of
+// them names its columns.
+var bookFacetQueries = map[string]string{
+	"genres": `
+		SELECT 'genres' AS facet, genre AS value, count(*) AS count, row_number() OVER (ORDER BY count(*) DESC, genre) AS rank
+		FROM matches, unnest(genres) AS genre
+		GROUP BY genre`,
+	"language": `
+		SELECT 'language' AS facet, language AS value, count(*) AS count, row_number() OVER (ORDER BY count(*) DESC, language) AS rank
+		FROM matches
+		GROUP BY language`,
+	"publisher": `
+		SELECT 'publisher' AS facet, publisher AS value, count(*) AS count, row_number() OVER (ORDER BY count(*) DESC, publisher) AS rank
+		FROM matches
+		GROUP BY publisher`,
+	"year": `
+		SELECT 'year' AS facet, (year / 10 * 10) || '-' || (year / 10 * 10 + 9) AS value, count(*) AS count, row_number() OVER (ORDER BY year / 10) AS rank
+		FROM matches
+		GROUP BY year / 10`,
+}
+
+// GetFacets counts the values of the given facets over the books matching the
+// filter, in a single query. The most common values come first, except for the
+// decades of the year facet, which are in order.
+func (b BookModel) GetFacets(filter BookFilter, facets []string) (map[string][]*FacetCount, error) {
+	counts := map[string][]*FacetCount{}
+	if len(facets) == 0 {
+		return counts, nil
+	}
+
+	var parts []string
+	for _, facet := range facets {
+		part, ok := bookFacetQueries[facet]
+		if !ok {
+			panic("unknown book facet: " + facet)
+		}
+		parts = append(parts, part)
+		counts[facet] = []*FacetCount{}
+	}
+
+	var args queryArgs
+	where := filter.where(&args)
+
+	query := fmt.Sprintf(`
+		WITH matches AS (
+			SELECT genres, language, publisher, year
+			FROM books
+			%s
+		)
+		SELECT facet, value, count
+		FROM (%s
+		) AS facets
+		WHERE rank <= %s OR facet = 'year'
+		ORDER BY facet, rank`, where, strings.Join(parts, "\n\t\tUNION ALL"), args.add(maxFacetValues))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := b.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var facet string
+		var count FacetCount
+
+		err := rows.Scan(&facet, &count.Value, &count.Count)
+		if err != nil {
+			return nil, err
+		}
+		counts[facet] = append(counts[facet], &count)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// BookSuggestion is a title or an author completing what a user typed, with the
+// number of books which have it.
+type BookSuggestion struct {
+	Field string `json:"field"`
+	Text  string `json:"text"`
+	Books int    `json:"books"`
+}
+
+// suggestTimeout limits the query of Suggest(), which runs as users type.
+const suggestTimeout = 200 * time.Millisecond
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Suggest returns up to limit titles and authors which start with the prefix,
+// have a word starting with it or, for typos, have a word similar to it. Those
+// starting with the prefix come first, then the most similar ones. If the query
+// doesn't finish within suggestTimeout, Suggest returns no suggestions rather
+// than late ones.
+func (b BookModel) Suggest(prefix string, limit int) ([]*BookSuggestion, error) {
+	query := `
+		SELECT field, value, count(*)
+		FROM (
+			SELECT 'title' AS field, title AS value
+			FROM books
+			WHERE deleted_at IS NULL AND (title ILIKE $1 OR title ILIKE $2 OR $3 <% title)
+			UNION ALL
+			SELECT 'author', author
+			FROM books
+			WHERE deleted_at IS NULL AND (author ILIKE $1 OR author ILIKE $2 OR $3 <% author)
+		) AS matches
+		GROUP BY field, value
+		ORDER BY value ILIKE $1 DESC, word_similarity($3, value) DESC, count(*) DESC, value
+		LIMIT $4`
+
+	escaped := likeEscaper.Replace(prefix)
+	args := []interface{}{escaped + "%", "% " + escaped + "%", prefix, limit}
+
+	ctx, cancel := context.WithTimeout(context.Background(), suggestTimeout)
+	defer cancel()
+
+	suggestions := []*BookSuggestion{}
+
+	rows, err := b.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return suggestions, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var suggestion BookSuggestion
+
+		err := rows.Scan(&suggestion.Field, &suggestion.Text, &suggestion.Books)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return []*BookSuggestion{}, nil
+		}
+		return nil, err
+	}
+
+	return suggestions, nil
+}
+
+// Export calls fn for every book matching the filter, in the order given by the
+// sort of filters; the cursor and cursor size are ignored. The books are read
+// from the database one at a time rather than all at once, so that the number
+// of books doesn't matter. Unlike the other queries, the duration of the export
+// is only limited by ctx, as it depends on the size of the catalog. An error
+// returned by fn stops the export and is returned by Export.
+func (b BookModel) Export(ctx context.Context, filter BookFilter, filters Filters, fn func(book *Book) error) error {
+	var args queryArgs
+	where := filter.where(&args)
+
+	query := fmt.Sprintf(`
+		SELECT id, created_at, isbn, title, author, genres, pages, language, publisher, year, version
+		FROM books
+		%s
+		ORDER BY %s %s, id %s`, where, filter.sortExpression(filters.sortColumn(), &args), filters.sortDirection(), filters.sortDirection())
+
+	rows, err := b.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var book Book
+		err := rows.Scan(
+			&book.ID,
+			&book.CreatedAt,
+			&book.ISBN,
+			&book.Title,
+			&book.Author,
+			pq.Array(&book.Genres),
+			&book.Pages,
+			&book.Language,
+			&book.Publisher,
+			&book.Year,
+			&book.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&book)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ValidateBookFilter checks the filters for listing books.
+func ValidateBookFilter(v *validator.Validator, f BookFilter) {
+	v.Check(len(f.Genres) <= 20, "genres", "must not contain more than 20 genres")
+	v.Check(len(f.Languages) <= 20, "language", "must not contain more than 20 languages")
+	v.Check(len(f.Publishers) <= 20, "publisher", "must not contain more than 20 publishers")
+
+	if f.YearMin != nil {
+		v.Check(*f.YearMin >= 0, "year_min", "must not be negative")
+		v.Check(*f.YearMin <= 9999, "year_min", "must be a maximum of 9999")
+	}
+	if f.YearMax != nil {
+		v.Check(*f.YearMax >= 0, "year_max", "must not be negative")
+		v.Check(*f.YearMax <= 9999, "year_max", "must be a maximum of 9999")
+	}
+	if f.YearMin != nil && f.YearMax != nil {
+		v.Check(*f.YearMin <= *f.YearMax, "year_max", "must not be less than year_min")
+	}
+
+	if f.PagesMin != nil {
+		v.Check(*f.PagesMin >= 0, "pages_min", "must not be negative")
+		v.Check(*f.PagesMin <= 1_000_000, "pages_min", "must be a maximum of 1 million")
+	}
+	if f.PagesMax != nil {
+		v.Check(*f.PagesMax >= 0, "pages_max", "must not be negative")
+		v.Check(*f.PagesMax <= 1_000_000, "pages_max", "must be a maximum of 1 million")
+	}
+	if f.PagesMin != nil && f.PagesMax != nil {
+		v.Check(*f.PagesMin <= *f.PagesMax, "pages_max", "must not be less than pages_min")
+	}
+
+	if f.CreatedAfter != nil && f.CreatedBefore != nil {
+		v.Check(f.CreatedAfter.Before(*f.CreatedBefore), "created_before", "must be after created_after")
+	}
+}
+
 // ValidateBook checks the validity of the provided book data
 func ValidateBook(v *validator.Validator, book *Book) {
-	// ISBN validation
+	// ISBN validation. A valid ISBN is normalized to its canonical ISBN-13 form,
+	// so that every book is stored the same way however its ISBN was entered.
 	v.Check(book.ISBN != "", "isbn", "must be provided")
-	v.Check(len(book.ISBN) == 13, "isbn", "must be 13 digit")
+	if book.ISBN != "" {
+		canonical, err := isbn.Normalize(book.ISBN)
+		switch {
+		case errors.Is(err, isbn.ErrInvalidChecksum):
+			v.AddError("isbn", "must have a valid check digit")
+		case err != nil:
+			v.AddError("isbn", "must be a valid ISBN-10 or ISBN-13")
+		default:
+			book.ISBN = canonical
+		}
+	}
 
 	// Title validation
 	v.Check(book.Title != "", "title", "must be provided")
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var errStopQuery = errors.New("stop query")
+
+// queryRecorder is a DBTX which records the queries run on it and fails them,
+// so that the SQL built by a model can be checked without a database.
+type queryRecorder struct {
+	queries []string
+}
+
+func (q *queryRecorder) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	q.queries = append(q.queries, query)
+	return nil, errStopQuery
+}
+
+func (q *queryRecorder) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	q.queries = append(q.queries, query)
+	return nil, errStopQuery
+}
+
+func (q *queryRecorder) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	q.queries = append(q.queries, query)
+	return nil, errStopQuery
+}
+
+func (q *queryRecorder) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	q.queries = append(q.queries, query)
+	return &sql.Row{}
+}
+
+func TestGetAllSearchWithFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter BookFilter
+		fields []string
+		sort   string
+	}{
+		{"title only", BookFilter{Query: "tolkien"}, []string{"title"}, "-relevance"},
+		{"id only", BookFilter{Query: "tolkien"}, []string{"id"}, "id"},
+		{"match only with language", BookFilter{Query: "tolkien", QueryLanguage: "en"}, []string{"match"}, "-relevance"},
+		{"isbn_10", BookFilter{Query: "tolkien"}, []string{"isbn_10", "year"}, "year"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &queryRecorder{}
+
+			filters := KeysetFilters{
+				CursorSize:   20,
+				Sort:         tt.sort,
+				SortSafeList: []string{tt.sort},
+			}
+
+			_, _, err := BookModel{DB: db}.GetAll(tt.filter, filters, tt.fields)
+			if !errors.Is(err, errStopQuery) {
+				t.Fatalf("got error %v; want %v", err, errStopQuery)
+			}
+			if len(db.queries) != 1 {
+				t.Fatalf("got %d queries; want 1", len(db.queries))
+			}
+
+			// The highlights are computed by the outer query from the columns of
+			// the page subquery, so the subquery must select all of them.
+			query := db.queries[0]
+			start := strings.Index(query, "FROM (")
+			end := strings.Index(query, "FROM books")
+			if start < 0 || end < start {
+				t.Fatalf("unexpected query: %s", query)
+			}
+			page := query[start:end]
+
+			for _, column := range []string{"title", "author", "publisher", "genres", "language"} {
+				if !strings.Contains(page, column) {
+					t.Errorf("page subquery doesn't select %s: %s", column, page)
+				}
+			}
+		})
+	}
+}
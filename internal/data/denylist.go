@@ -0,0 +1,61 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// JWTDenylistModel records the IDs (jti claims) of signed tokens that were
+// revoked before their expiry. Entries are only needed until the token expires.
+type JWTDenylistModel struct {
+	DB *sql.DB
+}
+
+// Add puts a token ID on the denylist until the given expiry, and removes any
+// entries whose tokens have expired in the meantime.
+func (m JWTDenylistModel) Add(jti string, expiry time.Time) error {
+	query := `
+		INSERT INTO jwt_denylist (jti, expiry)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, jti, expiry)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		DELETE FROM jwt_denylist
+		WHERE expiry < $1`
+
+	_, err = m.DB.ExecContext(ctx, query, time.Now())
+	return err
+}
+
+// Contains reports whether a token ID is on the denylist.
+func (m JWTDenylistModel) Contains(jti string) (bool, error) {
+	query := `
+		SELECT true
+		FROM jwt_denylist
+		WHERE jti = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var found bool
+	err := m.DB.QueryRowContext(ctx, query, jti).Scan(&found)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return found, nil
+}
@@ -1,7 +1,11 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"math"
+	"strconv"
 	"strings"
 
 	"github.com/barantoraman/GoBookAPI/internal/validator"
@@ -49,11 +53,13 @@ func (f Filters) offset() int {
 
 // for metadata
 type Metadata struct {
-	CurrentCursor int `json:"current_cursor,omitempty"`
-	CursorSize    int `json:"cursor_size,omitempty"`
-	FirstCursor   int `json:"first_cursor,omitempty"`
-	LastCursor    int `json:"last_cursor,omitempty"`
-	TotalRecords  int `json:"total_records,omitempty"`
+	CurrentCursor int    `json:"current_cursor,omitempty"`
+	CursorSize    int    `json:"cursor_size,omitempty"`
+	FirstCursor   int    `json:"first_cursor,omitempty"`
+	LastCursor    int    `json:"last_cursor,omitempty"`
+	NextCursor    string `json:"next_cursor,omitempty"`
+	PrevCursor    string `json:"prev_cursor,omitempty"`
+	TotalRecords  int    `json:"total_records,omitempty"`
 }
 
 func calculateMetadata(totalRecords, cursor, cursorSize int) Metadata {
@@ -69,3 +75,121 @@ func calculateMetadata(totalRecords, cursor, cursorSize int) Metadata {
 		TotalRecords:  totalRecords,
 	}
 }
+
+// ErrInvalidCursor is returned for cursors which were not issued for the listing
+// they are used with.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a listing paginated with KeysetFilters: the value of
+// the sort column and the ID of a record. Backward cursors read the records
+// before the position rather than after it.
+type Cursor struct {
+	Sort     string `json:"s"`
+	Key      string `json:"k"`
+	ID       int64  `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+// String encodes the cursor as an opaque string for clients.
+func (c Cursor) String() string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+// ParseCursor decodes a cursor encoded by String().
+func ParseCursor(s string) (*Cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+
+	err = json.Unmarshal(js, &c)
+	if err != nil || c.Sort == "" || c.ID < 1 {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// KeysetFilters holds the parameters of a listing paginated with cursors. Unlike
+// the page numbers of Filters, a cursor marks a position in the sorted records,
+// so pages neither skip nor repeat records added or removed between requests,
+// and a deep page is as fast to read as the first one. The total number of
+// records is only counted on request.
+type KeysetFilters struct {
+	Cursor       *Cursor
+	CursorSize   int
+	Sort         string
+	SortSafeList []string
+	Total        bool
+}
+
+func ValidateKeysetFilters(v *validator.Validator, f KeysetFilters) {
+	v.Check(f.CursorSize > 0, "cursor_size", "must be greater than zero")
+	v.Check(f.CursorSize <= 100, "cursor_size", "must be a maximum of 100")
+	// Check that the sort parameter matches a value in the safelist.
+	v.Check(validator.In(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+	if f.Cursor != nil {
+		v.Check(f.Cursor.Sort == f.Sort, "cursor", "does not match the sort")
+	}
+}
+
+func (f KeysetFilters) sortColumn() string {
+	return Filters{Sort: f.Sort, SortSafeList: f.SortSafeList}.sortColumn()
+}
+
+// sortDirection returns the direction in which the records are read, which is
+// the reverse of the sort for backward cursors.
+func (f KeysetFilters) sortDirection() string {
+	descending := strings.HasPrefix(f.Sort, "-")
+	if f.Cursor != nil && f.Cursor.Backward {
+		descending = !descending
+	}
+
+	if descending {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+// seek returns the condition which selects the records after the cursor in the
+// direction of sortDirection(), given the placeholders of the sort key and the
+// ID of the cursor.
+func (f KeysetFilters) seek(column, keyParam, idParam string) string {
+	operator := ">"
+	if f.sortDirection() == "DESC" {
+		operator = "<"
+	}
+	return "(" + column + ", id) " + operator + " (" + keyParam + ", " + idParam + ")"
+}
+
+// pageCursors returns the cursors of the pages after and before a page read with
+// the filters, given the sort keys and IDs of its first and last records in
+// order, and whether more records were read than fit on the page.
+func (f KeysetFilters) pageCursors(firstKey string, firstID int64, lastKey string, lastID int64, more bool) (next, prev string) {
+	backward := f.Cursor != nil && f.Cursor.Backward
+
+	// Going forward, there are records before the page if it started at a
+	// cursor, and after it if more were read. Going backward, it is the other way
+	// round.
+	if more || backward {
+		next = Cursor{Sort: f.Sort, Key: lastKey, ID: lastID}.String()
+	}
+	if (backward && more) || (!backward && f.Cursor != nil) {
+		prev = Cursor{Sort: f.Sort, Key: firstKey, ID: firstID, Backward: true}.String()
+	}
+	return next, prev
+}
+
+// queryArgs collects the arguments of a query which is built from optional parts.
+type queryArgs []interface{}
+
+// add appends an argument and returns its placeholder.
+func (a *queryArgs) add(arg interface{}) string {
+	*a = append(*a, arg)
+	return "$" + strconv.Itoa(len(*a))
+}
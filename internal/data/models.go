@@ -1,8 +1,12 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 var (
@@ -10,16 +14,113 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// uniqueViolation is the PostgreSQL error code for unique constraint violations.
+const uniqueViolation = "23505"
+
+// isUniqueViolation reports whether err is a violation of the given unique
+// constraint or unique index.
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation && pqErr.Constraint == constraint
+}
+
+// DBTX is the subset of the methods of sql.DB and sql.Tx used by the models, so
+// that a model can run its queries either on the pool or in a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 type Models struct {
-	Books  BookModel
-	Users  UserModel
-	Tokens TokenModel
+	APIKeys        APIKeyModel
+	Audit          AuditModel
+	Books          BookModel
+	JWTDenylist    JWTDenylistModel
+	LoginThrottles LoginThrottleModel
+	Permissions    PermissionModel
+	Users          UserModel
+	Tokens         TokenModel
+	TOTP           TOTPModel
+
+	db *sql.DB
+	tx *sql.Tx
 }
 
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Books:  BookModel{DB: db},
-		Users:  UserModel{DB: db},
-		Tokens: TokenModel{DB: db},
+		APIKeys:        APIKeyModel{DB: db},
+		Audit:          AuditModel{DB: db},
+		Books:          BookModel{DB: db},
+		JWTDenylist:    JWTDenylistModel{DB: db},
+		LoginThrottles: LoginThrottleModel{DB: db},
+		Permissions:    PermissionModel{DB: db},
+		Users:          UserModel{DB: db},
+		Tokens:         TokenModel{DB: db},
+		TOTP:           TOTPModel{DB: db},
+		db:             db,
+	}
+}
+
+// Transact calls fn with a copy of the models in which the catalog models (Books
+// and Audit) and the account models (Users, Permissions, Tokens and APIKeys) run
+// their queries in a single transaction. The transaction is committed if fn returns nil
+// and rolled back otherwise, and the error from fn is returned unchanged so that
+// callers can still check it with errors.Is().
+func (m Models) Transact(fn func(tx Models) error) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	txModels := m
+	txModels.APIKeys = APIKeyModel{DB: tx}
+	txModels.Audit = AuditModel{DB: tx}
+	txModels.Books = BookModel{DB: tx}
+	txModels.Permissions = PermissionModel{DB: tx}
+	txModels.Tokens = TokenModel{DB: tx}
+	txModels.Users = UserModel{DB: tx}
+	txModels.tx = tx
+
+	err = fn(txModels)
+	if err != nil {
+		return err
 	}
+
+	return tx.Commit()
+}
+
+// Savepoint calls fn within a savepoint of the transaction of models passed to a
+// Transact() function. If fn returns an error, the changes made by fn are rolled
+// back and the error is returned, but the transaction can go on.
+func (m Models) Savepoint(fn func() error) error {
+	if m.tx == nil {
+		return errors.New("savepoint outside of a transaction")
+	}
+
+	exec := func(query string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		_, err := m.tx.ExecContext(ctx, query)
+		return err
+	}
+
+	err := exec("SAVEPOINT models_savepoint")
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	if err != nil {
+		rollbackErr := exec("ROLLBACK TO SAVEPOINT models_savepoint")
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	return exec("RELEASE SAVEPOINT models_savepoint")
 }
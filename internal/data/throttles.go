@@ -0,0 +1,148 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LoginThrottle tracks the failed login attempts for a single key, such as an
+// account ("email:...") or a client IP address ("ip:..."). Keeping the counters
+// in PostgreSQL means that every instance of the API sees the same lockouts.
+type LoginThrottle struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+// Define the LoginThrottleModel type.
+type LoginThrottleModel struct {
+	DB *sql.DB
+}
+
+// LockedUntil returns the latest lockout expiry among the given keys, or the
+// zero time if none of them is currently locked.
+func (m LoginThrottleModel) LockedUntil(keys ...string) (time.Time, error) {
+	query := `
+		SELECT max(locked_until)
+		FROM login_throttles
+		WHERE key = ANY($1) AND locked_until > $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lockedUntil sql.NullTime
+	err := m.DB.QueryRowContext(ctx, query, pq.Array(keys), time.Now()).Scan(&lockedUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil.Time, nil
+}
+
+// RecordFailure counts a failed attempt for the key and returns the number of
+// consecutive failures. The count starts over once the key has seen no failure
+// and no lockout for the given window.
+func (m LoginThrottleModel) RecordFailure(key string, window time.Duration) (int, error) {
+	query := `
+		INSERT INTO login_throttles (key, failures, last_failure_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+			WHEN greatest(login_throttles.last_failure_at, login_throttles.locked_until) < $3 THEN 1
+			ELSE login_throttles.failures + 1
+		END,
+		last_failure_at = $2
+		RETURNING failures`
+
+	now := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failures int
+	err := m.DB.QueryRowContext(ctx, query, key, now, now.Add(-window)).Scan(&failures)
+	return failures, err
+}
+
+// Lock locks the key until the given time.
+func (m LoginThrottleModel) Lock(key string, until time.Time) error {
+	query := `
+		UPDATE login_throttles
+		SET locked_until = $2
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, until)
+	return err
+}
+
+// Reset clears the failures and any lockout of the key. It returns
+// ErrRecordNotFound if nothing was recorded for the key.
+func (m LoginThrottleModel) Reset(key string) error {
+	query := `
+		DELETE FROM login_throttles
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, key)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetAllLocked returns the keys which are currently locked, the longest
+// lockouts first.
+func (m LoginThrottleModel) GetAllLocked() ([]*LoginThrottle, error) {
+	query := `
+		SELECT key, failures, last_failure_at, locked_until
+		FROM login_throttles
+		WHERE locked_until > $1
+		ORDER BY locked_until DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	throttles := []*LoginThrottle{}
+
+	for rows.Next() {
+		var throttle LoginThrottle
+		err := rows.Scan(
+			&throttle.Key,
+			&throttle.Failures,
+			&throttle.LastFailureAt,
+			&throttle.LockedUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		throttles = append(throttles, &throttle)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return throttles, nil
+}
@@ -6,17 +6,45 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/barantoraman/GoBookAPI/internal/validator"
 )
 
+// Define constants for the token scope. Tokens of one scope cannot be used in
+// place of tokens of another.
+const (
+	ScopeActivation     = "activation"
+	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeTwoFactor      = "two-factor"
+)
+
+// ErrTokenReused is returned when a refresh token which has already been
+// exchanged is presented again.
+var ErrTokenReused = errors.New("token reused")
+
 // Define a Token struct to hold the data for an individual token.
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
+	Plaintext  string     `json:"token"`
+	Hash       []byte     `json:"-"`
+	UserID     int64      `json:"-"`
+	Expiry     time.Time  `json:"expiry"`
+	Scope      string     `json:"-"`
+	CreatedAt  time.Time  `json:"-"`
+	LastUsedAt *time.Time `json:"-"`
+	Family     []byte     `json:"-"`
+}
+
+// Session describes an active authentication token without exposing the token
+// itself.
+type Session struct {
+	CreatedAt  time.Time  `json:"created_at"`
+	Expiry     time.Time  `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Current    bool       `json:"current"`
 }
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
@@ -26,16 +54,29 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the TokenModel type.
 type TokenModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 // The New() method efficiently generates a fresh Token struct and seamlessly
 // populates the tokens table with the associated data.
-func (t TokenModel) New(userID int64, ttl time.Duration) (*Token, error) {
-	token, err := generateToken(userID, ttl)
+func (t TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = t.Insert(token)
+	return token, err
+}
+
+// NewForFamily() works like New() but links the token to a token family. All
+// access and refresh tokens issued from a single login share a family, so that
+// they can be revoked together.
+func (t TokenModel) NewForFamily(userID int64, ttl time.Duration, scope string, family []byte) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
+	token.Family = family
 	err = t.Insert(token)
 	return token, err
 }
@@ -43,15 +84,150 @@ func (t TokenModel) New(userID int64, ttl time.Duration) (*Token, error) {
 // Insert method adds the provided token data into the tokens table.
 func (t TokenModel) Insert(token *Token) error {
 	query := `
-	INSERT INTO tokens (hash, user_id, expiry) 
-	VALUES ($1, $2, $3)`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry}
+	INSERT INTO tokens (hash, user_id, expiry, scope, family) 
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING created_at`
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return t.DB.QueryRowContext(ctx, query, args...).Scan(&token.CreatedAt)
+}
+
+// GetAllForUser method returns the unexpired and unused tokens of a specific
+// scope associated with the given userID, newest first.
+func (t TokenModel) GetAllForUser(scope string, userID int64) ([]*Token, error) {
+	query := `
+	SELECT hash, user_id, expiry, scope, created_at, last_used_at, family
+	FROM tokens
+	WHERE scope = $1 AND user_id = $2 AND expiry > $3 AND used_at IS NULL
+	ORDER BY created_at DESC`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := t.DB.ExecContext(ctx, query, args...)
+
+	rows, err := t.DB.QueryContext(ctx, query, scope, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+
+	for rows.Next() {
+		var token Token
+		err := rows.Scan(
+			&token.Hash,
+			&token.UserID,
+			&token.Expiry,
+			&token.Scope,
+			&token.CreatedAt,
+			&token.LastUsedAt,
+			&token.Family,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// UseRefreshToken method marks an unexpired refresh token as used and returns it.
+// Refresh tokens can only be exchanged once: presenting a token which was
+// already used returns ErrTokenReused along with the token, so that the caller
+// can revoke its whole family.
+func (t TokenModel) UseRefreshToken(tokenPlaintext string) (*Token, error) {
+	query := `
+	UPDATE tokens
+	SET used_at = $3
+	WHERE hash = $1 AND scope = $2 AND expiry > $3 AND used_at IS NULL
+	RETURNING user_id, expiry, created_at, family`
+
+	token := &Token{
+		Plaintext: tokenPlaintext,
+		Hash:      TokenHash(tokenPlaintext),
+		Scope:     ScopeRefresh,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := t.DB.QueryRowContext(ctx, query, token.Hash, ScopeRefresh, time.Now()).Scan(
+		&token.UserID,
+		&token.Expiry,
+		&token.CreatedAt,
+		&token.Family,
+	)
+	if err == nil {
+		return token, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// The token is unknown, expired or already used. Only the last case is
+	// reported as a reuse.
+	query = `
+	SELECT user_id, expiry, created_at, family
+	FROM tokens
+	WHERE hash = $1 AND scope = $2 AND used_at IS NOT NULL`
+
+	err = t.DB.QueryRowContext(ctx, query, token.Hash, ScopeRefresh).Scan(
+		&token.UserID,
+		&token.Expiry,
+		&token.CreatedAt,
+		&token.Family,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return token, ErrTokenReused
+}
+
+// DeleteFamily method removes every token belonging to the given token family.
+func (t TokenModel) DeleteFamily(family []byte) error {
+	query := `
+	DELETE FROM tokens
+	WHERE family = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := t.DB.ExecContext(ctx, query, family)
 	return err
 }
 
+// DeleteByHash method removes the token with the given hash from the tokens
+// table, together with the other tokens of its family.
+func (t TokenModel) DeleteByHash(hash []byte) error {
+	query := `
+	DELETE FROM tokens
+	WHERE hash = $1
+	OR family = (SELECT family FROM tokens WHERE hash = $1)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := t.DB.ExecContext(ctx, query, hash)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
 // DeleteAllForUser method removes all tokens associated with
 // the given userID from the tokens table.
 func (t TokenModel) DeleteAllForUser(userID int64) error {
@@ -64,11 +240,24 @@ func (t TokenModel) DeleteAllForUser(userID int64) error {
 	return err
 }
 
-func generateToken(userID int64, ttl time.Duration) (*Token, error) {
-	// Create a Token instance containing the user ID and expiry information.
+// DeleteScopeForUser method removes the tokens of a specific scope associated
+// with the given userID from the tokens table.
+func (t TokenModel) DeleteScopeForUser(scope string, userID int64) error {
+	query := `
+	DELETE FROM tokens
+	WHERE scope = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := t.DB.ExecContext(ctx, query, scope, userID)
+	return err
+}
+
+func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	// Create a Token instance containing the user ID, expiry and scope information.
 	token := &Token{
 		UserID: userID,
 		Expiry: time.Now().Add(ttl),
+		Scope:  scope,
 	}
 	// Fill the byte slice using the Read() function from the crypto/rand package,
 	// which retrieves random bytes from the operating system's CSPRNG. An error
@@ -82,9 +271,24 @@ func generateToken(userID int64, ttl time.Duration) (*Token, error) {
 
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 
-	// Generate a SHA-256 hash of the plaintext token string.
-	// we convert it to a slice using the [:] operator before storing it.
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = TokenHash(token.Plaintext)
 	return token, nil
 }
+
+// GenerateFamily returns a random identifier for a new token family.
+func GenerateFamily() ([]byte, error) {
+	family := make([]byte, 16)
+	_, err := rand.Read(family)
+	if err != nil {
+		return nil, err
+	}
+	return family, nil
+}
+
+// TokenHash returns the SHA-256 hash of a plaintext token, which is the form in
+// which tokens are stored.
+func TokenHash(tokenPlaintext string) []byte {
+	// we convert the array to a slice using the [:] operator before returning it.
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
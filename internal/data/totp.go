@@ -0,0 +1,208 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TOTP holds the two-factor authentication enrolment of a user. The enrolment
+// only takes effect once the user has confirmed it with a valid code.
+type TOTP struct {
+	UserID    int64
+	CreatedAt time.Time
+	Secret    []byte
+	Confirmed bool
+	LastStep  int64
+}
+
+// Define the TOTPModel type.
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// Set starts a new, unconfirmed enrolment for the user with the given secret,
+// replacing any earlier unconfirmed one. A confirmed enrolment is left untouched
+// and reported as an edit conflict.
+func (m TOTPModel) Set(userID int64, secret []byte) error {
+	query := `
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_step = 0
+		WHERE user_totp.confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// Get retrieves the enrolment of a user, confirmed or not.
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, created_at, secret, confirmed, last_step
+		FROM user_totp
+		WHERE user_id = $1`
+
+	var totp TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&totp.UserID,
+		&totp.CreatedAt,
+		&totp.Secret,
+		&totp.Confirmed,
+		&totp.LastStep,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &totp, nil
+}
+
+// Confirm enables two-factor authentication for the user.
+func (m TOTPModel) Confirm(userID int64) error {
+	query := `
+		UPDATE user_totp
+		SET confirmed = true
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// UseStep records the time step of an accepted code. It returns false when a
+// code of the same or a later time step was already used, so that every code
+// is only accepted once.
+func (m TOTPModel) UseStep(userID, step int64) (bool, error) {
+	query := `
+		UPDATE user_totp
+		SET last_step = $2
+		WHERE user_id = $1 AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// Delete disables two-factor authentication for the user and removes the
+// recovery codes.
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID)
+	return err
+}
+
+// NewRecoveryCodes replaces the recovery codes of the user with ten new ones
+// and returns them. Only their hashes are stored.
+func (m TOTPModel) NewRecoveryCodes(userID int64) ([]string, error) {
+	codes := make([]string, 10)
+	hashes := make([][]byte, 10)
+
+	for i := range codes {
+		randomBytes := make([]byte, 5)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = TokenHash(normalizeRecoveryCode(codes[i]))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO recovery_codes (user_id, hash)
+		SELECT $1, unnest($2::bytea[])`
+
+	_, err = m.DB.ExecContext(ctx, query, userID, pq.ByteaArray(hashes))
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode marks an unused recovery code of the user as used, returning
+// false when no such code exists.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = $3
+		WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, TokenHash(normalizeRecoveryCode(code)), time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// normalizeRecoveryCode makes recovery codes case and separator insensitive.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -2,9 +2,12 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base32"
 	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/barantoraman/GoBookAPI/internal/validator"
@@ -15,7 +18,7 @@ var ErrDuplicateEmail = errors.New("duplicate email")
 var AnonymousUser = &User{}
 
 type UserModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 // struct to represent an individual user.
@@ -52,6 +55,27 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
+// Scramble replaces the password with a random one which nobody knows, so that
+// the user has to reset their password before they can log in again.
+func (p *password) Scramble() error {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	plaintextPassword := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	if err != nil {
+		return err
+	}
+	p.plaintext = nil
+	p.hash = hash
+	return nil
+}
+
 // Checks if the given plain-text password matches the stored hashed password.
 // Returns true if they match, false otherwise.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
@@ -118,6 +142,40 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Retrieve the User details from the database based on the user's ID.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = $1`
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
@@ -183,21 +241,36 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenPlaintext string) (*User, error) {
+// Retrieve the user associated with a token of the given scope, as long as the
+// token has not expired. The token's last-used time is recorded in the same query.
+func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	tokenHash := TokenHash(tokenPlaintext)
 
-	// Set up the SQL query to retrieve user data.
+	// Set up the SQL query to retrieve user data. The last use of the token is
+	// only written when the stored one is over a minute old, so that most
+	// requests don't write to the tokens table.
 	query := `
-	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version 
+	WITH token AS (
+		SELECT hash, user_id, last_used_at
+		FROM tokens
+		WHERE hash = $1
+		AND scope = $2
+		AND expiry > $3
+	), touched AS (
+		UPDATE tokens
+		SET last_used_at = $3
+		FROM token
+		WHERE tokens.hash = token.hash
+		AND (token.last_used_at IS NULL OR token.last_used_at < $3 - interval '1 minute')
+	)
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
 	FROM users
-	INNER JOIN tokens
-	ON users.id = tokens.user_id
-	WHERE tokens.hash = $1
-	AND tokens.expiry > $2`
+	INNER JOIN token
+	ON users.id = token.user_id`
 
-	// Create a slice containing the query arguments, including the token hash and current time.
-	args := []interface{}{tokenHash[:], time.Now()}
+	// Create a slice containing the query arguments, including the token hash, scope and current time.
+	args := []interface{}{tokenHash, tokenScope, time.Now()}
 
 	// Initialize a User struct to store the query result.
 	var user User
@@ -229,3 +302,152 @@ func (m UserModel) GetForToken(tokenPlaintext string) (*User, error) {
 	// Return the retrieved user information.
 	return &user, nil
 }
+
+// Delete the record for a specific user. The tokens, API keys, permissions and
+// two-factor authentication enrolment of the user are removed by the ON DELETE
+// CASCADE constraints on their tables.
+func (m UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetAll returns a page of the users matching the given filters, starting at the
+// cursor of filters. The email filter matches any part of the address, ignoring
+// case; nil filters are not applied. The metadata holds the cursors of the next
+// and previous pages, when there are any, and the total number of matching
+// users if filters asks for it.
+func (m UserModel) GetAll(email string, activated *bool, createdAfter, createdBefore *time.Time, filters KeysetFilters) ([]*User, Metadata, error) {
+	column := filters.sortColumn()
+	direction := filters.sortDirection()
+
+	args := queryArgs{email, activated, createdAfter, createdBefore}
+	where := `WHERE (strpos(lower(email), lower($1)) > 0 OR $1 = '')
+		AND (activated = $2 OR $2 IS NULL)
+		AND (created_at >= $3 OR $3 IS NULL)
+		AND (created_at < $4 OR $4 IS NULL)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	metadata := Metadata{CursorSize: filters.CursorSize}
+
+	if filters.Total {
+		query := "SELECT count(*) FROM users " + where
+
+		err := m.DB.QueryRowContext(ctx, query, args...).Scan(&metadata.TotalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	if filters.Cursor != nil {
+		// The keys of the id and created_at columns would otherwise fail in the
+		// query.
+		var err error
+		switch column {
+		case "id":
+			_, err = strconv.ParseInt(filters.Cursor.Key, 10, 64)
+		case "created_at":
+			_, err = time.Parse(time.RFC3339Nano, filters.Cursor.Key)
+		}
+		if err != nil {
+			return nil, Metadata{}, ErrInvalidCursor
+		}
+
+		where += " AND " + filters.seek(column, args.add(filters.Cursor.Key), args.add(filters.Cursor.ID))
+	}
+
+	// Read one more user than asked for, to find out whether there is a page after
+	// this one.
+	query := fmt.Sprintf(`
+		SELECT id, created_at, name, email, activated, version
+		FROM users
+		%s
+		ORDER BY %s %s, id %s
+		LIMIT %s`, where, column, direction, direction, args.add(filters.CursorSize+1))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	more := len(users) > filters.CursorSize
+	if more {
+		users = users[:filters.CursorSize]
+	}
+
+	if filters.Cursor != nil && filters.Cursor.Backward {
+		// The users were read in reverse, so put them back in order.
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+	}
+
+	if len(users) > 0 {
+		first, last := users[0], users[len(users)-1]
+
+		metadata.NextCursor, metadata.PrevCursor = filters.pageCursors(userSortKey(first, column), first.ID, userSortKey(last, column), last.ID, more)
+	}
+
+	return users, metadata, nil
+}
+
+// userSortKey returns the value of the sort column of a user, as stored in
+// cursors.
+func userSortKey(user *User, column string) string {
+	switch column {
+	case "name":
+		return user.Name
+	case "email":
+		return user.Email
+	case "created_at":
+		return user.CreatedAt.Format(time.RFC3339Nano)
+	default:
+		return strconv.FormatInt(user.ID, 10)
+	}
+}
@@ -0,0 +1,104 @@
+// Package isbn parses and validates International Standard Book Numbers.
+//
+// Both the 10-digit ISBN-10 and the 13-digit ISBN-13 forms are accepted, with
+// or without hyphens and spaces. ISBN-13 is the canonical form: every ISBN-10
+// has an ISBN-13 equivalent with the 978 prefix, but only ISBN-13s with the 978
+// prefix have an ISBN-10 equivalent.
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidFormat is returned for values which are not 10 or 13 digits long
+	// once separators are removed, or which contain other characters. Only the
+	// last digit of an ISBN-10 may be an X.
+	ErrInvalidFormat = errors.New("isbn: invalid format")
+
+	// ErrInvalidChecksum is returned when the check digit doesn't match.
+	ErrInvalidChecksum = errors.New("isbn: invalid check digit")
+
+	// ErrInvalidPrefix is returned for ISBN-13s which don't start with the 978
+	// or 979 prefix.
+	ErrInvalidPrefix = errors.New("isbn: invalid prefix")
+)
+
+// Normalize parses an ISBN-10 or ISBN-13 and returns its canonical ISBN-13 form,
+// without separators.
+func Normalize(s string) (string, error) {
+	digits := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+
+	switch len(digits) {
+	case 10:
+		if !isDigits(digits[:9]) || !(isDigits(digits[9:]) || digits[9] == 'X') {
+			return "", ErrInvalidFormat
+		}
+		if checkDigit10(digits[:9]) != digits[9] {
+			return "", ErrInvalidChecksum
+		}
+		return "978" + digits[:9] + string(checkDigit13("978"+digits[:9])), nil
+	case 13:
+		if !isDigits(digits) {
+			return "", ErrInvalidFormat
+		}
+		if !strings.HasPrefix(digits, "978") && !strings.HasPrefix(digits, "979") {
+			return "", ErrInvalidPrefix
+		}
+		if checkDigit13(digits[:12]) != digits[12] {
+			return "", ErrInvalidChecksum
+		}
+		return digits, nil
+	default:
+		return "", ErrInvalidFormat
+	}
+}
+
+// To10 returns the ISBN-10 form of a canonical ISBN-13, as returned by
+// Normalize(). It returns an empty string for ISBN-13s without an ISBN-10 form.
+func To10(isbn13 string) string {
+	if len(isbn13) != 13 || !strings.HasPrefix(isbn13, "978") || !isDigits(isbn13) {
+		return ""
+	}
+	return isbn13[3:12] + string(checkDigit10(isbn13[3:12]))
+}
+
+// checkDigit10 computes the ISBN-10 check digit of the first nine digits, with
+// weights from 10 down to 2, modulo 11. A check value of 10 is written as X.
+func checkDigit10(digits string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(digits[i]-'0') * (10 - i)
+	}
+
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// checkDigit13 computes the ISBN-13 check digit of the first twelve digits, with
+// alternating weights of 1 and 3, modulo 10.
+func checkDigit13(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(digits[i]-'0') * weight
+	}
+
+	return byte('0' + (10-sum%10)%10)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package isbn
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		err   error
+	}{
+		{"ISBN-10", "0306406152", "9780306406157", nil},
+		{"ISBN-10 with hyphens", "0-306-40615-2", "9780306406157", nil},
+		{"ISBN-10 with spaces", "0 306 40615 2", "9780306406157", nil},
+		{"ISBN-10 with X check digit", "080442957X", "9780804429573", nil},
+		{"ISBN-10 with lowercase x", "0-8044-2957-x", "9780804429573", nil},
+		{"ISBN-13 with 978 prefix", "9780306406157", "9780306406157", nil},
+		{"ISBN-13 with hyphens", "978-0-306-40615-7", "9780306406157", nil},
+		{"ISBN-13 with 979 prefix", "9791069150003", "9791069150003", nil},
+		{"ISBN-10 with bad check digit", "0306406153", "", ErrInvalidChecksum},
+		{"ISBN-10 with X in the wrong place", "03064061X2", "", ErrInvalidFormat},
+		{"ISBN-10 with X instead of a digit", "030640615X", "", ErrInvalidChecksum},
+		{"ISBN-13 with bad check digit", "9780306406158", "", ErrInvalidChecksum},
+		{"ISBN-13 with X", "978030640615X", "", ErrInvalidFormat},
+		{"ISBN-13 with unknown prefix", "9770306406157", "", ErrInvalidPrefix},
+		{"letters", "03064O6152", "", ErrInvalidFormat},
+		{"too short", "030640615", "", ErrInvalidFormat},
+		{"too long", "97803064061570", "", ErrInvalidFormat},
+		{"empty", "", "", ErrInvalidFormat},
+		{"other separator", "0.306.40615.2", "", ErrInvalidFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Normalize(tt.input)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Normalize(%q) error = %v; want %v", tt.input, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("Normalize(%q) = %q; want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTo10(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"978 prefix", "9780306406157", "0306406152"},
+		{"X check digit", "9780804429573", "080442957X"},
+		{"979 prefix", "9791069150003", ""},
+		{"ISBN-10", "0306406152", ""},
+		{"not digits", "978030640615X", ""},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := To10(tt.input)
+			if got != tt.want {
+				t.Errorf("To10(%q) = %q; want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, isbn10 := range []string{"0306406152", "080442957X", "155404295X", "043942089X"} {
+		isbn13, err := Normalize(isbn10)
+		if err != nil {
+			t.Fatalf("Normalize(%q) error = %v", isbn10, err)
+		}
+
+		if got := To10(isbn13); got != isbn10 {
+			t.Errorf("To10(Normalize(%q)) = %q; want %q", isbn10, got, isbn10)
+		}
+
+		again, err := Normalize(To10(isbn13))
+		if err != nil || again != isbn13 {
+			t.Errorf("Normalize(To10(%q)) = %q, %v; want %q", isbn13, again, err, isbn13)
+		}
+	}
+}
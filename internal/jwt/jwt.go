@@ -0,0 +1,129 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for every token that fails to parse or verify.
+// The reason is deliberately not exposed to callers.
+var ErrInvalidToken = errors.New("jwt: invalid token")
+
+// Claims holds the registered claims used by the API along with the user
+// details needed to serve a request without a database lookup. The subject is
+// the user ID, encoded as a string as RFC 7519 requires.
+type Claims struct {
+	ID          string   `json:"jti"`
+	Issuer      string   `json:"iss"`
+	Subject     int64    `json:"sub,string"`
+	IssuedAt    int64    `json:"iat"`
+	NotBefore   int64    `json:"nbf"`
+	Expiry      int64    `json:"exp"`
+	Name        string   `json:"name"`
+	Email       string   `json:"email"`
+	Activated   bool     `json:"activated"`
+	Permissions []string `json:"permissions"`
+	Family      string   `json:"fam,omitempty"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign encodes the claims as a compact JWT signed with the signing key.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Algorithm: ks.signing.Algorithm, Type: "JWT", KeyID: ks.signing.ID})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+
+	return signingInput + "." + encoding.EncodeToString(ks.signing.sign([]byte(signingInput))), nil
+}
+
+// Verify checks the token signature with the key named by its kid header and
+// validates the issuer and the time based claims against now.
+func (ks *KeySet) Verify(token, issuer string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	err := decodeSegment(parts[0], &h)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// The algorithm is bound to the key, so a token can't pick a weaker one.
+	key, ok := ks.keys[h.KeyID]
+	if !ok || h.Algorithm != key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	unix := now.Unix()
+	if claims.Issuer != issuer || claims.Expiry <= unix || claims.NotBefore > unix {
+		return nil, ErrInvalidToken
+	}
+
+	return &claims, nil
+}
+
+func (k *Key) sign(input []byte) []byte {
+	switch k.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	default:
+		return ed25519.Sign(k.private, input)
+	}
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	switch k.Algorithm {
+	case HS256:
+		return hmac.Equal(signature, k.sign(input))
+	default:
+		return ed25519.Verify(k.public, input, signature)
+	}
+}
+
+func decodeSegment(segment string, dst interface{}) error {
+	b, err := encoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
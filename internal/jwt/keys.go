@@ -0,0 +1,93 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Supported signing algorithms.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+// Key is a single signing key, identified in token headers by its ID (kid).
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+}
+
+// ParseKey parses a key specification of the form "kid:alg:material", where
+// material is the base64 encoded HMAC secret (at least 32 bytes) for HS256, or
+// the base64 encoded 32 byte Ed25519 seed for EdDSA.
+func ParseKey(spec string) (*Key, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, errors.New("jwt: key must be in the format kid:alg:base64")
+	}
+
+	material, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: key %q is not valid base64", parts[0])
+	}
+
+	key := &Key{ID: parts[0], Algorithm: parts[1]}
+
+	switch key.Algorithm {
+	case HS256:
+		if len(material) < 32 {
+			return nil, fmt.Errorf("jwt: HS256 key %q must be at least 32 bytes long", key.ID)
+		}
+		key.secret = material
+	case EdDSA:
+		if len(material) != ed25519.SeedSize {
+			return nil, fmt.Errorf("jwt: EdDSA key %q must be a %d byte seed", key.ID, ed25519.SeedSize)
+		}
+		key.private = ed25519.NewKeyFromSeed(material)
+		key.public = key.private.Public().(ed25519.PublicKey)
+	default:
+		return nil, fmt.Errorf("jwt: key %q has unsupported algorithm %q", key.ID, key.Algorithm)
+	}
+
+	return key, nil
+}
+
+// KeySet holds the keys used to sign and verify tokens. The first key is used
+// for signing new tokens; the others are only used for verification, so that
+// tokens signed with a retired key stay valid until they expire.
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// NewKeySet creates a KeySet from one or more key specifications, as accepted
+// by ParseKey. The first specification becomes the signing key.
+func NewKeySet(specs ...string) (*KeySet, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("jwt: at least one key is required")
+	}
+
+	ks := &KeySet{keys: make(map[string]*Key)}
+
+	for i, spec := range specs {
+		key, err := ParseKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+		if i == 0 {
+			ks.signing = key
+		}
+	}
+
+	return ks, nil
+}
@@ -0,0 +1,99 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"time"
+
+	ttemplate "text/template"
+)
+
+// templateFS holds the email templates. Each template file defines a "subject",
+// a "plainBody" and an "htmlBody" block.
+//
+//go:embed "templates"
+var templateFS embed.FS
+
+// Transport delivers a rendered Message. The SMTP transport is used in production,
+// while the file and memory transports are sinks for development and tests.
+type Transport interface {
+	Deliver(msg *Message) error
+}
+
+// Mailer renders templated emails and hands them over to a Transport.
+type Mailer struct {
+	transport Transport
+	sender    string
+}
+
+// New creates a new Mailer which sends emails from the given sender address
+// through the given transport.
+func New(transport Transport, sender string) Mailer {
+	return Mailer{
+		transport: transport,
+		sender:    sender,
+	}
+}
+
+// Send renders the named template with the dynamic data and delivers the result
+// to the recipient. Delivery is retried up to three times before giving up.
+func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+	msg, err := m.render(recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i <= 3; i++ {
+		err = m.transport.Deliver(msg)
+		if err == nil {
+			return nil
+		}
+		// If it didn't work, sleep for a short time and retry.
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return err
+}
+
+// render executes the subject, plain-text and HTML blocks of the template file.
+func (m Mailer) render(recipient, templateFile string, data interface{}) (*Message, error) {
+	tmpl, err := ttemplate.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	plainBody := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The HTML body is rendered with html/template so that the dynamic data is
+	// escaped properly.
+	htmlTmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody := new(bytes.Buffer)
+	err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		From:      m.sender,
+		To:        recipient,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	}
+	return msg, nil
+}
@@ -0,0 +1,70 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileTransport writes every message as an .eml file into a directory instead
+// of sending it, which is handy when running the API locally.
+type FileTransport struct {
+	dir string
+}
+
+// NewFileTransport creates a transport writing into dir, creating it if needed.
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTransport{dir: dir}, nil
+}
+
+// Deliver writes the encoded message to a file named after the current time and
+// the recipient.
+func (t *FileTransport) Deliver(msg *Message) error {
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	recipient := strings.NewReplacer("@", "_at_", "/", "_", "<", "", ">", "", " ", "_").Replace(envelopeAddress(msg.To))
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), recipient)
+
+	return os.WriteFile(filepath.Join(t.dir, name), body, 0o644)
+}
+
+// MemoryTransport keeps delivered messages in memory so that tests can inspect
+// them. It is safe for concurrent use.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewMemoryTransport creates an empty in-memory outbox.
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+// Deliver stores a copy of the message.
+func (t *MemoryTransport) Deliver(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, *msg)
+	return nil
+}
+
+// Messages returns a copy of all messages delivered so far.
+func (t *MemoryTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	messages := make([]Message, len(t.messages))
+	copy(messages, t.messages)
+	return messages
+}
@@ -0,0 +1,92 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// SMTPTransport delivers messages through an SMTP server.
+type SMTPTransport struct {
+	host     string
+	port     int
+	username string
+	password string
+	timeout  time.Duration
+}
+
+// NewSMTPTransport creates a transport for the SMTP server at host:port. The
+// username and password are only used when the username is not empty.
+func NewSMTPTransport(host string, port int, username, password string) *SMTPTransport {
+	return &SMTPTransport{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		timeout:  5 * time.Second,
+	}
+}
+
+// Deliver sends the message, upgrading the connection with STARTTLS whenever the
+// server supports it.
+func (t *SMTPTransport) Deliver(msg *Message) error {
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(t.host, strconv.Itoa(t.port))
+	conn, err := net.DialTimeout("tcp", addr, t.timeout)
+	if err != nil {
+		return err
+	}
+	// Bound the whole SMTP conversation, not just the dial.
+	conn.SetDeadline(time.Now().Add(2 * t.timeout))
+
+	c, err := smtp.NewClient(conn, t.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: t.host})
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.username != "" {
+		err = c.Auth(smtp.PlainAuth("", t.username, t.password, t.host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(envelopeAddress(msg.From))
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(envelopeAddress(msg.To))
+	if err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
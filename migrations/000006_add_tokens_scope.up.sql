@@ -0,0 +1,2 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS scope text NOT NULL DEFAULT 'authentication';
+ALTER TABLE tokens ALTER COLUMN scope DROP DEFAULT;
\ No newline at end of file
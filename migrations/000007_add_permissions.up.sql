@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS permissions (
+    id bigserial PRIMARY KEY,
+    code text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO permissions (code)
+VALUES
+    ('books:read'),
+    ('books:write'),
+    ('users:admin');
+
+-- Users created before permissions existed keep full access to the catalog.
+INSERT INTO users_permissions
+SELECT users.id, permissions.id FROM users CROSS JOIN permissions
+WHERE permissions.code IN ('books:read', 'books:write');
\ No newline at end of file
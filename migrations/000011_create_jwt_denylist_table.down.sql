@@ -0,0 +1 @@
+DROP TABLE IF EXISTS jwt_denylist;
\ No newline at end of file
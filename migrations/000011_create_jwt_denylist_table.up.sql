@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS jwt_denylist (
+    jti text PRIMARY KEY,
+    expiry timestamp(0) with time zone NOT NULL
+);
\ No newline at end of file
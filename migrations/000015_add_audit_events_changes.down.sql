@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS audit_events_actor_id_idx;
+
+ALTER TABLE audit_events DROP COLUMN IF EXISTS after;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS before;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS request_id;
\ No newline at end of file
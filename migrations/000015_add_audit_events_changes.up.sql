@@ -0,0 +1,5 @@
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS request_id text NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS before jsonb;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS after jsonb;
+
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id);
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS book_versions;
\ No newline at end of file
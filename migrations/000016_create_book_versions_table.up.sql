@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS book_versions (
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    version integer NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    isbn text NOT NULL,
+    title text NOT NULL,
+    author text NOT NULL,
+    genres text[] NOT NULL,
+    pages integer NOT NULL,
+    language text NOT NULL,
+    publisher text NOT NULL,
+    year integer NOT NULL,
+    PRIMARY KEY (book_id, version)
+);
+
+-- The earlier revisions of existing books are lost, but their current one is kept.
+INSERT INTO book_versions (book_id, version, isbn, title, author, genres, pages, language, publisher, year)
+SELECT id, version, isbn, title, author, genres, pages, language, publisher, year FROM books
+ON CONFLICT DO NOTHING;
\ No newline at end of file
@@ -0,0 +1 @@
+-- The original form of the ISBNs is not kept, so there is nothing to revert.
\ No newline at end of file
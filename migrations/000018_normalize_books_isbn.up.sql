@@ -0,0 +1,12 @@
+-- Books used to be stored with their ISBN as entered. Remove the separators and
+-- convert ISBN-10s to ISBN-13s, to match the canonical form used from now on.
+UPDATE books SET isbn = upper(regexp_replace(isbn, '[-[:space:]]', '', 'g'))
+WHERE isbn ~ '[-[:space:]]' OR isbn ~ 'x$';
+
+UPDATE books SET isbn = '978' || left(isbn, 9) || (
+    (10 - (
+        SELECT sum(substr('978' || left(isbn, 9), i, 1)::integer * CASE WHEN i % 2 = 0 THEN 3 ELSE 1 END)
+        FROM generate_series(1, 12) AS i
+    ) % 10) % 10
+)::text
+WHERE isbn ~ '^[0-9]{9}[0-9X]$';
\ No newline at end of file
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS books_isbn_idx ON books (isbn);
+
+DROP INDEX IF EXISTS books_isbn_unique_idx;
\ No newline at end of file
@@ -0,0 +1,27 @@
+-- Books which share an ISBN must be resolved by hand before the unique index can
+-- be created, so the migration fails with a list of them instead of deleting any.
+DO $$
+DECLARE
+    duplicates text;
+BEGIN
+    SELECT string_agg(format('%s (books %s)', isbn, ids), '; ' ORDER BY isbn)
+    INTO duplicates
+    FROM (
+        SELECT isbn, string_agg(id::text, ', ' ORDER BY id) AS ids
+        FROM books
+        WHERE deleted_at IS NULL
+        GROUP BY isbn
+        HAVING count(*) > 1
+    ) AS shared;
+
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'books share ISBNs: %', duplicates
+            USING HINT = 'Correct or delete the duplicate books, then run the migration again.';
+    END IF;
+END
+$$;
+
+-- Trashed books don't count, so that a deleted book can be entered again.
+CREATE UNIQUE INDEX IF NOT EXISTS books_isbn_unique_idx ON books (isbn) WHERE deleted_at IS NULL;
+
+DROP INDEX IF EXISTS books_isbn_idx;
\ No newline at end of file
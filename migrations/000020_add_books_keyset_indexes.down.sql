@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS books_title_id_idx;
+DROP INDEX IF EXISTS books_author_id_idx;
+DROP INDEX IF EXISTS books_year_id_idx;
\ No newline at end of file
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS books_title_id_idx ON books (title, id) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS books_author_id_idx ON books (author, id) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS books_year_id_idx ON books (year, id) WHERE deleted_at IS NULL;
\ No newline at end of file
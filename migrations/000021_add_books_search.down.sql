@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS books_search_idx;
+ALTER TABLE books DROP COLUMN IF EXISTS search;
+DROP FUNCTION IF EXISTS books_search_vector(text, text, text, text[], text);
+DROP FUNCTION IF EXISTS books_search_config(text);
\ No newline at end of file
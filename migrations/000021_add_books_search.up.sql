@@ -0,0 +1,41 @@
+-- books_search_config maps the language of a book, given as an ISO 639-1 code or
+-- an English name, to the text search configuration for it.
+CREATE OR REPLACE FUNCTION books_search_config(language text) RETURNS regconfig
+LANGUAGE sql IMMUTABLE AS $$
+    SELECT CASE lower(trim(language))
+        WHEN 'da' THEN 'danish' WHEN 'danish' THEN 'danish'
+        WHEN 'nl' THEN 'dutch' WHEN 'dutch' THEN 'dutch'
+        WHEN 'en' THEN 'english' WHEN 'english' THEN 'english'
+        WHEN 'fi' THEN 'finnish' WHEN 'finnish' THEN 'finnish'
+        WHEN 'fr' THEN 'french' WHEN 'french' THEN 'french'
+        WHEN 'de' THEN 'german' WHEN 'german' THEN 'german'
+        WHEN 'hu' THEN 'hungarian' WHEN 'hungarian' THEN 'hungarian'
+        WHEN 'it' THEN 'italian' WHEN 'italian' THEN 'italian'
+        WHEN 'no' THEN 'norwegian' WHEN 'nb' THEN 'norwegian' WHEN 'norwegian' THEN 'norwegian'
+        WHEN 'pt' THEN 'portuguese' WHEN 'portuguese' THEN 'portuguese'
+        WHEN 'ro' THEN 'romanian' WHEN 'romanian' THEN 'romanian'
+        WHEN 'ru' THEN 'russian' WHEN 'russian' THEN 'russian'
+        WHEN 'es' THEN 'spanish' WHEN 'spanish' THEN 'spanish'
+        WHEN 'sv' THEN 'swedish' WHEN 'swedish' THEN 'swedish'
+        WHEN 'tr' THEN 'turkish' WHEN 'turkish' THEN 'turkish'
+        ELSE 'simple'
+    END::regconfig
+$$;
+
+-- books_search_vector builds the document searched by ?q=. Every field is indexed
+-- both with the configuration of the language of the book, for stemmed matches,
+-- and with the simple configuration, for exact matches in any language. The title
+-- weighs most (A), then the author (B), then the publisher and genres (C).
+CREATE OR REPLACE FUNCTION books_search_vector(title text, author text, publisher text, genres text[], language text) RETURNS tsvector
+LANGUAGE sql IMMUTABLE AS $$
+    SELECT
+        setweight(to_tsvector(books_search_config(language), title) || to_tsvector('simple', title), 'A') ||
+        setweight(to_tsvector(books_search_config(language), author) || to_tsvector('simple', author), 'B') ||
+        setweight(to_tsvector(books_search_config(language), publisher || ' ' || array_to_string(genres, ' ')) ||
+            to_tsvector('simple', publisher || ' ' || array_to_string(genres, ' ')), 'C')
+$$;
+
+ALTER TABLE books ADD COLUMN search tsvector
+    GENERATED ALWAYS AS (books_search_vector(title, author, publisher, genres, language)) STORED;
+
+CREATE INDEX IF NOT EXISTS books_search_idx ON books USING GIN (search);
\ No newline at end of file
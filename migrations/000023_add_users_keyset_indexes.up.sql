@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS users_name_id_idx ON users (name, id);
+CREATE INDEX IF NOT EXISTS users_email_id_idx ON users (email, id);
+CREATE INDEX IF NOT EXISTS users_created_at_id_idx ON users (created_at, id);
\ No newline at end of file